@@ -1,3 +1,3 @@
 module hlsdump
 
-go 1.12
+go 1.15
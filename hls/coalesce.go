@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (seg *segment) byteRange() bool {
+	return seg.length > 0 && seg.offset >= 0 && seg.marker == ""
+}
+
+// coalesceSegments collects queued segments that directly follow seg in the
+// same resource, up to the configured span. The first segment that cannot be
+// coalesced is returned separately.
+func (s *stream) coalesceSegments(seg *segment) (segments []*segment, next *segment) {
+	segments = []*segment{seg}
+	if !seg.byteRange() || seg.written > 0 {
+		return
+	}
+
+	last := seg
+	for {
+		select {
+		case n, ok := <-s.output.queue.c:
+			if !ok {
+				return
+			}
+			if !n.byteRange() || n.uri != seg.uri || n.offset != last.offset+last.length ||
+				n.offset+n.length-seg.offset > s.d.CoalesceSpan {
+				next = n
+				return
+			}
+			segments = append(segments, n)
+			last = n
+		default:
+			return
+		}
+	}
+}
+
+// downloadRange fetches adjacent segments with a single ranged request and
+// splits the response into the individual segments. It returns the segments
+// that still need to be downloaded separately.
+func (s *stream) downloadRange(req *http.Request, segments []*segment) (rest []*segment, err error) {
+	rest = segments
+	first, last := segments[0], segments[len(segments)-1]
+	if s.d.Verbose {
+		log.Printf("Downloading segments %d-%d: %s\n", first.sequence, last.sequence, first.uri)
+	}
+
+	if req.URL, err = s.resolve(first.uri); err != nil {
+		return
+	}
+	req.Host = req.URL.Host
+
+	start, end := first.offset, last.offset+last.length-1
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Del("If-Range")
+
+	var duration int
+	for _, seg := range segments {
+		duration += seg.duration
+	}
+	s.output.client.Timeout = time.Duration(duration) * time.Duration(s.d.SegmentTimeout) * time.Second
+	rec := s.newRecord(RequestSegment, first)
+	rec.Count = len(segments)
+	resp, err := s.d.do(&s.output.client, req, rec)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		err = httpResponseStatusError(resp)
+		return
+	}
+	if err = checkContentRange(resp, start, end); err != nil {
+		return
+	}
+
+	validator := responseValidator(resp)
+	ext := s.d.segmentExtension(req.URL, resp)
+	for len(rest) > 0 {
+		seg := rest[0]
+		seg.ext = ext
+		if err = s.copySegment(seg, resp.Body, validator); err != nil {
+			return
+		}
+		rest = rest[1:]
+	}
+	return
+}
+
+// copySegment writes the next segment from the coalesced response. If the
+// response ends early, the segment file is kept open so that processSegment
+// can resume it.
+func (s *stream) copySegment(seg *segment, r io.Reader, validator string) (err error) {
+	outputFile, err := s.openSegment(seg)
+	if err != nil {
+		return
+	}
+
+	n, err := io.CopyN(outputFile, r, seg.length)
+	seg.written += n
+	seg.validator = validator
+	if err != nil {
+		return
+	}
+
+	return s.finishSegment(seg, outputFile)
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadRangeCutOff(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") == "bytes=0-299" {
+			// Cut the coalesced response off in the middle of the second segment
+			w.Header().Set("Content-Range", "bytes 0-299/300")
+			w.Header().Set("Content-Length", "300")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[:150])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Dumper{
+		Name:           "test",
+		Storage:        DirStorage{Dir: dir},
+		SegmentTimeout: 5,
+		Retry:          RetryPolicy{MaxAttempts: 3},
+		RoundTripper:   http.DefaultTransport,
+	}
+	s := &stream{d: d, name: "test"}
+	s.playlist.url, _ = url.Parse(srv.URL + "/test.m3u8")
+	s.playlist.name = "test.m3u8"
+	s.playlist.writer = bufio.NewWriter(ioutil.Discard)
+	s.output.client = d.newClient(0)
+
+	req, err := d.newRequest(s.playlist.url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var segments []*segment
+	for i := 0; i < 3; i++ {
+		segments = append(segments, &segment{
+			sequence: i + 1,
+			duration: 1,
+			uri:      "test.ts",
+			offset:   int64(i * 100),
+			length:   100,
+		})
+	}
+
+	rest, err := s.downloadRange(req, segments)
+	if err == nil {
+		t.Fatal("expected error for incomplete response")
+	}
+	if len(rest) != 2 || rest[0] != segments[1] || segments[1].written != 50 {
+		t.Fatalf("unexpected state after incomplete response: %d remaining, %d bytes written",
+			len(rest), segments[1].written)
+	}
+	for _, seg := range rest {
+		if err = s.processSegment(req, seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, seg := range segments {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("test-%d.ts", seg.sequence)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[i*100:(i+1)*100]) {
+			t.Errorf("segment %d has wrong content: %v", seg.sequence, b)
+		}
+	}
+}
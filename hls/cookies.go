@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// CookieJar is a http.CookieJar that remembers all stored cookies,
+// so they can be saved to a Netscape cookies.txt file.
+type CookieJar struct {
+	jar     *cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]*cookieEntry
+}
+
+type cookieEntry struct {
+	http.Cookie
+	subdomains bool
+}
+
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &CookieJar{
+		jar:     jar,
+		cookies: make(map[string]*cookieEntry),
+	}
+}
+
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range cookies {
+		e := &cookieEntry{Cookie: *c}
+		if e.Domain == "" {
+			e.Domain = u.Hostname()
+		} else {
+			e.Domain = strings.TrimPrefix(e.Domain, ".")
+			e.subdomains = true
+		}
+		if e.Path == "" || e.Path[0] != '/' {
+			e.Path = defaultCookiePath(u.EscapedPath())
+		}
+		if e.MaxAge > 0 {
+			e.Expires = now.Add(time.Duration(e.MaxAge) * time.Second)
+		}
+
+		key := e.Domain + ";" + e.Path + ";" + e.Name
+		if e.MaxAge < 0 || (!e.Expires.IsZero() && e.Expires.Before(now)) {
+			delete(j.cookies, key)
+		} else if j.accepted(u, e) {
+			j.cookies[key] = e
+		}
+	}
+}
+
+// accepted checks if the jar stored the cookie, i.e. it returns the cookie
+// for its domain and path. Cookies that were rejected (e.g. for a domain
+// that does not match the host that set them) are not saved.
+func (j *CookieJar) accepted(u *url.URL, e *cookieEntry) bool {
+	scheme := u.Scheme
+	if e.Secure {
+		scheme = "https"
+	}
+	for _, c := range j.jar.Cookies(&url.URL{Scheme: scheme, Host: e.Domain, Path: e.Path}) {
+		if c.Name == e.Name && c.Value == e.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCookiePath returns the default path of cookies set for the
+// request path p (RFC 6265, section 5.1.4).
+func defaultCookiePath(p string) string {
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	return path.Dir(p)
+}
+
+// Load adds all cookies from a Netscape cookies.txt file to the jar.
+func (j *CookieJar) Load(name string) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = line[len(httpOnlyPrefix):]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			err = fmt.Errorf("%s:%d: expected 7 fields, got %d", name, i, len(fields))
+			return
+		}
+
+		var expires int64
+		if expires, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+			err = fmt.Errorf("%s:%d: invalid expiry: %s", name, i, err)
+			return
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			HttpOnly: httpOnly,
+		}
+		if fields[1] == "TRUE" {
+			c.Domain = domain
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+			if c.Expires.Before(now) {
+				continue
+			}
+		}
+
+		u := &url.URL{Scheme: "http", Host: domain, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		j.SetCookies(u, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+// Save writes all cookies that have not expired to a Netscape cookies.txt file.
+func (j *CookieJar) Save(name string) (err error) {
+	f, err := createFileWriteOnly(name)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	j.mu.Lock()
+	keys := make([]string, 0, len(j.cookies))
+	for k := range j.cookies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString("# Netscape HTTP Cookie File\n")
+	for _, k := range keys {
+		c := j.cookies[k]
+		var expires int64
+		if !c.Expires.IsZero() {
+			if c.Expires.Before(now) {
+				continue
+			}
+			expires = c.Expires.Unix()
+		}
+
+		domain := c.Domain
+		if c.subdomains {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, netscapeBool(c.subdomains),
+			c.Path, netscapeBool(c.Secure), expires, c.Name, c.Value)
+	}
+	j.mu.Unlock()
+
+	return w.Flush()
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
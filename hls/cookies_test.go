@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testCookies = `# Netscape HTTP Cookie File
+.example.com	TRUE	/	FALSE	4102444800	session	abc
+#HttpOnly_example.com	FALSE	/videos	TRUE	0	token	xyz
+`
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestCookieJarRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jar := NewCookieJar()
+	input := testCookies + ".example.com\tTRUE\t/\tFALSE\t1\texpired\tx\n"
+	if err = jar.Load(writeTestFile(t, dir, "cookies.txt", input)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url     string
+		cookies []string
+	}{
+		{"https://example.com/videos/a.ts", []string{"session=abc", "token=xyz"}},
+		{"https://cdn.example.com/videos/a.ts", []string{"session=abc"}},
+		{"http://example.com/videos/a.ts", []string{"session=abc"}},
+		{"https://example.com/other", []string{"session=abc"}},
+		{"https://example.org/", nil},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		var cookies []string
+		for _, c := range jar.Cookies(u) {
+			cookies = append(cookies, c.String())
+		}
+		sort.Strings(cookies)
+		if strings.Join(cookies, "; ") != strings.Join(test.cookies, "; ") {
+			t.Errorf("cookies for %s = %v, want %v", test.url, cookies, test.cookies)
+		}
+	}
+
+	saved := filepath.Join(dir, "saved.txt")
+	if err = jar.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != testCookies {
+		t.Errorf("saved cookies:\n%s\nwant:\n%s", b, testCookies)
+	}
+}
+
+func TestCookieJarLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, line := range []string{
+		"example.com\tFALSE\t/\tFALSE\t0\tname",
+		"example.com\tFALSE\t/\tFALSE\tnever\tname\tvalue",
+	} {
+		if err = NewCookieJar().Load(writeTestFile(t, dir, "cookies.txt", line+"\n")); err == nil {
+			t.Errorf("Load accepted invalid line %q", line)
+		}
+	}
+}
+
+func TestCookieJarSetCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jar := NewCookieJar()
+	set := func(rawurl string, cookies ...*http.Cookie) {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jar.SetCookies(u, cookies)
+	}
+	set("https://evil.test/", &http.Cookie{Name: "stolen", Value: "x", Domain: "bank.example"})
+	set("https://cdn.example.com", &http.Cookie{Name: "empty", Value: "x"})
+	set("https://cdn.example.com/a/b.m3u8", &http.Cookie{Name: "dir", Value: "x"},
+		&http.Cookie{Name: "parent", Value: "x", Domain: "example.com", Path: "/"})
+
+	saved := filepath.Join(dir, "saved.txt")
+	if err = jar.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Netscape HTTP Cookie File
+cdn.example.com	FALSE	/	FALSE	0	empty	x
+cdn.example.com	FALSE	/a	FALSE	0	dir	x
+.example.com	TRUE	/	FALSE	0	parent	x
+`
+	if string(b) != want {
+		t.Errorf("saved cookies:\n%s\nwant:\n%s", b, want)
+	}
+}
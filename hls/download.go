@@ -3,28 +3,110 @@
 package hls
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"path"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type output struct {
-	client   http.Client
-	file     *os.File
-	offset   int64
-	sequence int
-	queue    struct {
+	client      http.Client
+	file        File
+	segmentFile File
+	name        string
+	ext         string
+	rangeFiles  map[string]File
+	resources   map[string]bool
+	offset      int64
+	sequence    int
+	queue       struct {
 		c        chan *segment
 		sequence int
 	}
 }
 
+var (
+	errInvalidContentRange = errors.New("invalid Content-Range")
+	errSegmentChanged      = errors.New("segment changed while resuming")
+)
+
+func parseContentRange(v string) (start, end, total int64, err error) {
+	unit, v := splitPair(v, ' ')
+	if unit != "bytes" {
+		err = errInvalidContentRange
+		return
+	}
+
+	v, t := splitPair(v, '/')
+	s, e := splitPair(v, '-')
+	if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+		return
+	}
+	if end, err = strconv.ParseInt(e, 10, 64); err != nil {
+		return
+	}
+	if end < start {
+		err = errInvalidContentRange
+		return
+	}
+
+	total = -1
+	if t != "*" {
+		total, err = strconv.ParseInt(t, 10, 64)
+	}
+	return
+}
+
+// checkContentRange verifies that a partial response covers the requested
+// range. If end is negative, the range must extend to the end of the resource.
+func checkContentRange(resp *http.Response, start, end int64) (err error) {
+	v := resp.Header.Get("Content-Range")
+	rstart, rend, total, err := parseContentRange(v)
+	if err != nil {
+		err = incompleteError{fmt.Errorf("%s: '%s'", errInvalidContentRange, v)}
+		return
+	}
+
+	if end < 0 && total >= 0 {
+		end = total - 1
+	}
+	if rstart != start || (end >= 0 && rend != end) {
+		err = incompleteError{fmt.Errorf("server returned range %d-%d instead of %d-%d", rstart, rend, start, end)}
+	}
+	return
+}
+
+func checkSegmentSize(resp *http.Response, size int64) error {
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return incompleteError{fmt.Errorf("incomplete segment: received %d of %d bytes", size, resp.ContentLength)}
+	}
+	return nil
+}
+
+// responseValidator returns a validator suitable for If-Range, preferring
+// strong ETags over Last-Modified.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
 func (s *stream) processSegment(req *http.Request, seg *segment) (err error) {
+	if seg.marker != "" {
+		defer s.playlist.flush(&err)
+		if err = fatal(writeLine(s.playlist.writer, seg.marker)); err != nil {
+			log.Println("Failed to write marker:", err)
+		}
+		return
+	}
+
+	s.saveResources(seg)
+
 	if seg.length == 0 {
 		err = fatal(s.processSkippedSegment(seg))
 		if err != nil {
@@ -33,8 +115,13 @@ func (s *stream) processSegment(req *http.Request, seg *segment) (err error) {
 		return
 	}
 
-	var try uint
+	defer s.abortSegmentFile()
+
+	var try int
+	resigned := false
 	for {
+		playlistURL := s.playlistURL()
+		seg.retries = try
 		err = s.downloadSegment(req, seg)
 		if err == nil {
 			return
@@ -42,11 +129,21 @@ func (s *stream) processSegment(req *http.Request, seg *segment) (err error) {
 
 		try++
 		log.Printf("Failed to download segment %d (try %d): %s\n", seg.sequence, try, err)
-		if _, ok := err.(fatalError); ok {
+		if s.d.Resign && !resigned && isAuthError(err) {
+			resigned = true
+			rerr := s.resignSegment(seg, playlistURL)
+			if rerr == nil {
+				continue
+			}
+			log.Println("Failed to re-sign stream:", rerr)
+		}
+
+		if err = s.d.Retry.check(err, try, seg.added); err != nil {
+			log.Printf("Giving up on segment %d: %s\n", seg.sequence, err)
 			break
 		}
 
-		time.Sleep(time.Duration(64<<min(try, 4)) * time.Millisecond)
+		time.Sleep(s.d.Retry.backoff(try))
 		if s.d.stop {
 			return
 		}
@@ -89,59 +186,205 @@ func (s *stream) processSkippedSegment(seg *segment) (err error) {
 	return
 }
 
+func (s *stream) segmentFile(seg *segment) (f File, err error) {
+	if s.d.SingleFile {
+		if s.output.file == nil {
+			// Use the extension of the first segment for the stream
+			s.output.ext = seg.ext
+			s.output.name = s.segmentName(nil)
+			if s.output.file, err = s.d.outputStorage().Create(s.output.name); err != nil {
+				log.Println("Failed to create output file", err)
+				err = fatal(err)
+			}
+		}
+		return s.output.file, err
+	}
+	if s.mirrorRange(seg) {
+		s.output.name = s.segmentName(seg)
+		return s.rangeFile(s.output.name)
+	}
+
+	if s.output.segmentFile == nil {
+		s.output.name = s.segmentName(seg)
+		s.output.segmentFile, err = s.d.outputStorage().Create(s.output.name)
+	}
+	return s.output.segmentFile, err
+}
+
+// commitSegmentFile stores the finished segment file. If that fails, the
+// segment must be downloaded again.
+func (s *stream) commitSegmentFile(seg *segment) (err error) {
+	f := s.output.segmentFile
+	s.output.segmentFile = nil
+	if err = f.Close(); err != nil {
+		seg.written = 0
+		seg.validator = ""
+		err = fmt.Errorf("failed to store segment: %s", err)
+	}
+	return
+}
+
+// abortSegmentFile discards the file of a segment that was not finished.
+func (s *stream) abortSegmentFile() {
+	if s.output.segmentFile == nil {
+		return
+	}
+	if err := s.output.segmentFile.Abort(); err != nil {
+		log.Println("Failed to remove segment file:", err)
+	}
+	s.output.segmentFile = nil
+}
+
+func (s *stream) closeOutputFile(erro *error) {
+	if s.output.file == nil {
+		return
+	}
+
+	// Remove the incomplete data of a failed last segment
+	err := s.output.file.Truncate(s.output.offset)
+	if cerr := s.output.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Failed to close output file:", err)
+		if *erro == nil {
+			*erro = err
+		}
+	}
+}
+
 func (s *stream) downloadSegment(req *http.Request, seg *segment) (err error) {
 	if s.d.Verbose {
 		log.Println("Downloading:", seg.uri)
 	}
 
-	if req.URL, err = s.playlist.url.Parse(seg.uri); err != nil {
+	if req.URL, err = s.resolve(seg.uri); err != nil {
 		return
 	}
 	req.Host = req.URL.Host
 
-	var expectedStatus int
-	if seg.length >= 0 && seg.offset >= 0 {
+	byteRange := seg.length >= 0 && seg.offset >= 0
+	if seg.written > 0 && seg.validator == "" {
+		log.Println("Cannot resume segment", seg.sequence, "without validator, restarting")
+		seg.written = 0
+	}
+
+	var start, end int64 = 0, -1
+	if byteRange {
+		start, end = seg.offset, seg.offset+seg.length-1
+	}
+	start += seg.written
+
+	expectedStatus := http.StatusOK
+	if byteRange || seg.written > 0 {
 		// Partial request
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.offset, seg.offset+seg.length-1))
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+		}
 		expectedStatus = http.StatusPartialContent
 	} else {
 		req.Header.Del("Range")
-		expectedStatus = http.StatusOK
+	}
+	if seg.written > 0 && seg.validator != "" {
+		req.Header.Set("If-Range", seg.validator)
+	} else {
+		req.Header.Del("If-Range")
 	}
 
 	s.output.client.Timeout = time.Duration(seg.duration) * time.Duration(s.d.SegmentTimeout) * time.Second
-	resp, err := s.output.client.Do(req)
+	resp, err := s.d.do(&s.output.client, req, s.newRecord(RequestSegment, seg))
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
+	if seg.written > 0 && resp.StatusCode == http.StatusOK {
+		// Server ignored the range or the resource changed
+		log.Println("Cannot resume segment", seg.sequence, "from byte", seg.written, "restarting")
+		seg.written = 0
+		seg.validator = ""
+		expectedStatus = http.StatusOK
+		if byteRange {
+			// The full resource is useless for byte range segments, try again
+			err = httpResponseStatusError(resp)
+			return
+		}
+	}
 	if resp.StatusCode != expectedStatus {
 		err = httpResponseStatusError(resp)
 		return
 	}
 
-	outputFile := s.output.file
-	if outputFile == nil {
-		outputFile, err = createFileWriteOnly(fmt.Sprintf("%s-%d.ts", s.name, seg.sequence))
-		if err != nil {
+	if resp.StatusCode == http.StatusPartialContent {
+		if err = checkContentRange(resp, start, end); err != nil {
 			return
 		}
-		defer outputFile.Close()
 	}
+	validator := responseValidator(resp)
+	if seg.written > 0 && validator != seg.validator {
+		// Server ignored If-Range, do not mix two versions of the resource
+		seg.written = 0
+		seg.validator = ""
+		err = incompleteError{errSegmentChanged}
+		return
+	}
+	seg.validator = validator
+	seg.ext = s.d.segmentExtension(req.URL, resp)
 
-	size, err := io.Copy(outputFile, resp.Body)
+	outputFile, err := s.openSegment(seg)
 	if err != nil {
-		if s.d.SingleFile {
-			if _, err2 := outputFile.Seek(s.output.offset, io.SeekStart); err2 != nil {
-				log.Println("Failed to seek to previous offset:", err2)
-				err = fatal(err)
-			}
-		}
+		return
+	}
 
+	n, err := io.Copy(outputFile, resp.Body)
+	seg.written += n
+	if err == nil {
+		err = checkSegmentSize(resp, n)
+	}
+	if err == nil && byteRange && seg.written != seg.length {
+		err = incompleteError{fmt.Errorf("incomplete segment: received %d of %d bytes", seg.written, seg.length)}
+	}
+	if err != nil {
 		return
 	}
 
+	return s.finishSegment(seg, outputFile)
+}
+
+// openSegment returns the output file for the segment, positioned after
+// the bytes that were already written for it.
+func (s *stream) openSegment(seg *segment) (f File, err error) {
+	if f, err = s.segmentFile(seg); err != nil {
+		return
+	}
+
+	var base int64
+	if s.d.SingleFile {
+		base = s.output.offset
+	} else if s.mirrorRange(seg) {
+		base = seg.offset
+	}
+	if _, err = f.Seek(base+seg.written, io.SeekStart); err != nil {
+		log.Println("Failed to seek to previous offset:", err)
+		err = fatal(err)
+	}
+	return
+}
+
+func (s *stream) finishSegment(seg *segment, outputFile File) (err error) {
+	size := seg.written
+	if outputFile == s.output.segmentFile {
+		if err = fatal(outputFile.Truncate(size)); err != nil {
+			return
+		}
+		// Store the segment before it is added to the playlist
+		if err = s.commitSegmentFile(seg); err != nil {
+			return
+		}
+	}
+
 	start := s.output.offset
 	s.output.offset += size
 
@@ -161,7 +404,18 @@ func (s *stream) downloadSegment(req *http.Request, seg *segment) (err error) {
 			return
 		}
 	}
-	if err = fatal(writeLine(s.playlist.writer, path.Base(outputFile.Name()))); err != nil {
+
+	ref := relativeName(s.playlist.name, s.output.name)
+	if s.d.Mirror {
+		if s.mirrorRange(seg) {
+			if _, err = fmt.Fprintf(s.playlist.writer, "#EXT-X-BYTERANGE:%d@%d\n", seg.length, seg.offset); err != nil {
+				err = fatal(err)
+				return
+			}
+		}
+		ref = s.d.mirrorReference(s.baseURL(), s.query, s.playlist.name, seg.uri)
+	}
+	if err = fatal(writeLine(s.playlist.writer, ref)); err != nil {
 		return
 	}
 
@@ -172,6 +426,7 @@ func (s *stream) downloadWorker() (err error) {
 	if s.d.SegmentTimeout < 0 {
 		s.d.SegmentTimeout = 5
 	}
+	s.output.client = s.d.newClient(0)
 
 	req, err := s.d.newRequest(s.playlist.url.String())
 	if err != nil {
@@ -179,25 +434,49 @@ func (s *stream) downloadWorker() (err error) {
 	}
 
 	if s.d.SingleFile {
-		if s.output.file, err = createFileWriteOnly(s.name + ".ts"); err != nil {
-			log.Println("Failed to create output file", err)
-			return
-		}
-		defer s.output.file.Close()
+		defer s.closeOutputFile(&err)
 	}
 
 	if s.d.stop {
 		return
 	}
+	defer s.closeRangeFiles(&err)
+	defer s.abortSegmentFile()
+
+	var next *segment
+	for {
+		seg := next
+		if seg == nil {
+			var ok bool
+			if seg, ok = <-s.output.queue.c; !ok {
+				break
+			}
+		}
+		next = nil
 
-	for seg := range s.output.queue.c {
 		if s.d.stop {
 			return
 		}
 
-		if err = s.processSegment(req, seg); err != nil {
-			if ferr, ok := err.(fatalError); ok && !ferr.client {
-				return
+		segments := []*segment{seg}
+		if s.d.CoalesceSpan > 0 && s.playlist.vod {
+			segments, next = s.coalesceSegments(seg)
+			if len(segments) > 1 {
+				if segments, err = s.downloadRange(req, segments); err != nil {
+					log.Printf("Failed to download segments %d-%d: %s\n",
+						segments[0].sequence, segments[len(segments)-1].sequence, err)
+					if ferr, ok := err.(fatalError); ok && !ferr.client {
+						return
+					}
+				}
+			}
+		}
+
+		for _, seg := range segments {
+			if err = s.processSegment(req, seg); err != nil {
+				if ferr, ok := err.(fatalError); ok && !ferr.client {
+					return
+				}
 			}
 		}
 	}
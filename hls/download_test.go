@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value             string
+		start, end, total int64
+		err               bool
+	}{
+		{"bytes 0-99/100", 0, 99, 100, false},
+		{"bytes 100-199/*", 100, 199, -1, false},
+		{"bytes 5-5/6", 5, 5, 6, false},
+		{"bytes 10-5/100", 0, 0, 0, true},
+		{"bytes */100", 0, 0, 0, true},
+		{"items 0-99/100", 0, 0, 0, true},
+		{"bytes 0-99/many", 0, 0, 0, true},
+		{"", 0, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		start, end, total, err := parseContentRange(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseContentRange(%q) returned error %v", test.value, err)
+			continue
+		}
+		if err == nil && (start != test.start || end != test.end || total != test.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, want %d, %d, %d",
+				test.value, start, end, total, test.start, test.end, test.total)
+		}
+	}
+}
+
+func TestCheckContentRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+		err        bool
+	}{
+		{"bytes 0-99/100", 0, 99, false},
+		{"bytes 50-99/100", 50, -1, false},
+		{"bytes 50-89/100", 50, -1, true},
+		{"bytes 50-89/*", 50, -1, false},
+		{"bytes 0-99/100", 10, 99, true},
+		{"bytes 0-49/100", 0, 99, true},
+		{"invalid", 0, 99, true},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{"Content-Range": {test.value}}}
+		err := checkContentRange(resp, test.start, test.end)
+		if (err != nil) != test.err {
+			t.Errorf("checkContentRange(%q, %d, %d) returned error %v", test.value, test.start, test.end, err)
+		}
+		if _, ok := err.(incompleteError); err != nil && !ok {
+			t.Errorf("checkContentRange(%q) returned %T instead of incompleteError", test.value, err)
+		}
+	}
+}
+
+// failingStorage fails to store the first file that is closed,
+// like a failed upload.
+type failingStorage struct {
+	DirStorage
+	failed bool
+}
+
+type failingFile struct {
+	File
+	s *failingStorage
+}
+
+func (s *failingStorage) Create(name string) (File, error) {
+	f, err := s.DirStorage.Create(name)
+	return failingFile{f, s}, err
+}
+
+func (f failingFile) Close() error {
+	if !f.s.failed {
+		f.s.failed = true
+		_ = f.File.Abort()
+		return errors.New("upload failed")
+	}
+	return f.File.Close()
+}
+
+func TestProcessSegmentStoreFailure(t *testing.T) {
+	data := []byte("segment data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Dumper{
+		Name:           "test",
+		Storage:        &failingStorage{DirStorage: DirStorage{Dir: dir}},
+		SegmentTimeout: 5,
+		Retry:          RetryPolicy{MaxAttempts: 3, Backoff: 1, MaxBackoff: 1},
+		RoundTripper:   http.DefaultTransport,
+	}
+	s := &stream{d: d, name: "test"}
+	s.playlist.url, _ = url.Parse(srv.URL + "/test.m3u8")
+	s.playlist.name = "test.m3u8"
+	var playlist bytes.Buffer
+	s.playlist.writer = bufio.NewWriter(&playlist)
+	s.output.client = d.newClient(0)
+
+	req, err := d.newRequest(s.playlist.url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := &segment{sequence: 1, duration: 1, uri: "test.ts", offset: -1, length: -1}
+	if err = s.processSegment(req, seg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := playlist.String(); got != "test-1.ts\n" {
+		t.Errorf("playlist = %q, want a single entry", got)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "test-1.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("segment = %q, want %q", b, data)
+	}
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Request kinds that can be used in HeaderRule.Kinds.
+const (
+	RequestMaster  = "master"
+	RequestMedia   = "media"
+	RequestKey     = "key"
+	RequestSegment = "segment"
+)
+
+// sensitiveHeaders from Dumper.Headers are only sent to the origin
+// of the master playlist and Dumper.AuthHosts.
+var sensitiveHeaders = []string{"Authorization", "Cookie"}
+
+// redactHeaders returns a copy of the headers without the values of the
+// sensitive headers, for logs and archives.
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"(redacted)"}
+		}
+	}
+	return h
+}
+
+// HeaderRule adds headers to requests for hosts matching the Host pattern
+// (all hosts if empty) and the request kinds in Kinds (all kinds if empty).
+type HeaderRule struct {
+	Host   string
+	Kinds  []string
+	Header http.Header
+}
+
+func (r *HeaderRule) match(u *url.URL, kind string) bool {
+	return (r.Host == "" || matchHost(r.Host, u)) &&
+		(len(r.Kinds) == 0 || contains(r.Kinds, kind))
+}
+
+// ParseHeaderRule parses a header rule in the format
+// "host[/kind,...] Name: value".
+func ParseHeaderRule(value string) (rule HeaderRule, err error) {
+	scope, header := splitPair(value, ' ')
+	host, kinds := splitPair(scope, '/')
+	if host != "*" {
+		rule.Host = host
+	}
+	if kinds != "" {
+		rule.Kinds = strings.Split(kinds, ",")
+		for _, kind := range rule.Kinds {
+			switch kind {
+			case RequestMaster, RequestMedia, RequestKey, RequestSegment:
+			default:
+				err = fmt.Errorf("invalid request kind '%s' in header rule", kind)
+				return
+			}
+		}
+	}
+
+	h, err := ParseHeaders([]string{strings.TrimSpace(header)})
+	if err != nil || len(h) == 0 {
+		err = fmt.Errorf("invalid header in header rule '%s'", value)
+		return
+	}
+	rule.Header = http.Header(h)
+	return
+}
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// readNetrc parses a .netrc file. An empty name reads $NETRC or ~/.netrc.
+func readNetrc(name string) (machines map[string]netrcEntry, err error) {
+	if name == "" {
+		if name = os.Getenv("NETRC"); name == "" {
+			var home string
+			if home, err = os.UserHomeDir(); err != nil {
+				return
+			}
+			name = filepath.Join(home, ".netrc")
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+
+	machines = make(map[string]netrcEntry)
+	var machine string
+	var entry netrcEntry
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine", "default":
+			if machine != "" {
+				machines[machine] = entry
+			}
+			machine, entry = "", netrcEntry{}
+			if scanner.Text() == "default" {
+				machine = "*"
+			} else if scanner.Scan() {
+				machine = scanner.Text()
+			}
+		case "login":
+			if scanner.Scan() {
+				entry.login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() {
+				entry.password = scanner.Text()
+			}
+		}
+	}
+	if machine != "" {
+		machines[machine] = entry
+	}
+	return machines, scanner.Err()
+}
+
+func basicAuth(userinfo string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(userinfo))
+}
+
+func (d *Dumper) authorizedHost(u *url.URL) bool {
+	if d.origin != nil && u.Scheme == d.origin.Scheme && u.Host == d.origin.Host {
+		return true
+	}
+	for _, pattern := range d.AuthHosts {
+		if matchHost(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRequest returns a copy of the request with the rewritten URL and
+// all headers that apply to it.
+func (d *Dumper) prepareRequest(req *http.Request, kind string) (*http.Request, error) {
+	r := req.WithContext(req.Context())
+	u, err := d.rewriteURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u != req.URL {
+		r.URL = u
+		r.Host = u.Host
+	}
+
+	r.Header = req.Header.Clone()
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+
+	authorized := d.authorizedHost(r.URL)
+	for k, v := range d.Headers {
+		if authorized || !contains(sensitiveHeaders, http.CanonicalHeaderKey(k)) {
+			r.Header[k] = v
+		}
+	}
+
+	if authorized {
+		if d.User != "" {
+			r.Header.Set("Authorization", basicAuth(d.User))
+		} else if d.BearerToken != "" {
+			r.Header.Set("Authorization", "Bearer "+d.BearerToken)
+		}
+	}
+
+	for _, rule := range d.HeaderRules {
+		if rule.match(r.URL, kind) {
+			for k, v := range rule.Header {
+				r.Header[k] = v
+			}
+		}
+	}
+
+	if r.Header.Get("Authorization") == "" && d.netrc != nil {
+		entry, ok := d.netrc[r.URL.Hostname()]
+		if !ok && authorized {
+			entry, ok = d.netrc["*"]
+		}
+		if ok {
+			r.Header.Set("Authorization", basicAuth(entry.login+":"+entry.password))
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPrepareRequestAuthorization(t *testing.T) {
+	origin, _ := url.Parse("https://origin.example/master.m3u8")
+	d := &Dumper{
+		origin:    origin,
+		AuthHosts: []string{"keys.example"},
+		Headers:   map[string][]string{"Cookie": {"session=abc"}, "X-Custom": {"1"}},
+		netrc: map[string]netrcEntry{
+			"cdn.example": {"cdn", "secret"},
+			"*":           {"default", "secret"},
+		},
+	}
+	defaultAuth := basicAuth("default:secret")
+
+	tests := []struct {
+		url           string
+		authorization string
+		cookie        string
+	}{
+		{"https://origin.example/media.m3u8", defaultAuth, "session=abc"},
+		{"https://keys.example/key", defaultAuth, "session=abc"},
+		{"https://cdn.example/segment.ts", basicAuth("cdn:secret"), ""},
+		{"https://third-party.example/segment.ts", "", ""},
+		{"http://origin.example/media.m3u8", "", ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := d.prepareRequest(req, RequestSegment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := r.Header.Get("Authorization"); v != test.authorization {
+			t.Errorf("Authorization for %s = %q, want %q", test.url, v, test.authorization)
+		}
+		if v := r.Header.Get("Cookie"); v != test.cookie {
+			t.Errorf("Cookie for %s = %q, want %q", test.url, v, test.cookie)
+		}
+		if r.Header.Get("X-Custom") != "1" {
+			t.Errorf("X-Custom missing for %s", test.url)
+		}
+	}
+}
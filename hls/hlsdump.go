@@ -5,6 +5,8 @@ package hls
 import (
 	"errors"
 	"log"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 )
@@ -12,6 +14,14 @@ import (
 type stream struct {
 	d        *Dumper
 	name     string
+	index    int
+	attr     map[string]string
+	language string
+	key      string
+	query    url.Values
+	removed  bool
+	ended    bool
+	mu       sync.Mutex
 	playlist playlist
 	output   output
 }
@@ -25,9 +35,111 @@ type Dumper struct {
 	Groups     []string
 	Titles     []string
 
+	// Storage stores all output files (DirStorage{} if nil).
+	Storage Storage
+	// PlaylistTemplate and SegmentTemplate are the names of the output
+	// files, see CheckTemplate and CheckSegmentTemplate. They may contain
+	// directories, the playlists reference the segments relative to them.
+	PlaylistTemplate string
+	SegmentTemplate  string
+	// Extension overrides the file extension of the segments, which is
+	// derived from their URI or Content-Type otherwise.
+	Extension string
+	// Mirror stores all files at a path derived from their URL (host/path)
+	// instead, including keys and init sections. Absolute URIs in the
+	// playlists are replaced by relative ones.
+	Mirror bool
+
 	PlaylistTimeout time.Duration
 	SegmentTimeout  int
+	Retry           RetryPolicy
+
+	// CoalesceSpan is the maximum size of a ranged request that fetches
+	// adjacent EXT-X-BYTERANGE segments of VOD playlists at once.
+	CoalesceSpan int64
+
+	// Transport configures the HTTP transport shared by all requests.
+	// RoundTripper overrides it if set, otherwise it is set by Start.
+	Transport    TransportOptions
+	RoundTripper http.RoundTripper
+
+	// Jar is shared by all requests. If SaveCookies is set and Jar is a
+	// *CookieJar, the cookies are saved to that file when the dump ends.
+	Jar         http.CookieJar
+	SaveCookies string
+
+	// Resign fetches the master playlist again to obtain fresh URLs when
+	// requests are rejected with HTTP 401/403. ResignCommand optionally
+	// prints a new master playlist URL for that.
+	Resign        bool
+	ResignCommand string
+	resignMu      sync.Mutex
+
+	// Metadata records all requests with the address of the server
+	// in <Name>-metadata.jsonl.
+	Metadata bool
+	metadata metadata
+
+	// HTTPLog records all HTTP exchanges with their timings to this file,
+	// as HAR if the name ends with .har and as JSON lines otherwise.
+	HTTPLog string
+	httpLog *httpLog
+
+	// WARC writes all requests and responses as WARC/1.1 records to this
+	// file, in addition to the usual output files unless WARCOnly is set.
+	// The metadata, HTTP log and snapshots are still stored if enabled.
+	WARC     string
+	WARCOnly bool
+	warc     *warc
+
+	// Snapshots stores the raw response of each media playlist reload
+	// in <stream>-snapshots, together with an index of all reloads.
+	Snapshots bool
+
+	// HeaderRules add headers to requests depending on host and kind.
+	// Authorization and Cookie from Headers as well as User and BearerToken
+	// are only sent to the origin of the master playlist and AuthHosts.
+	HeaderRules []HeaderRule
+	User        string
+	BearerToken string
+	AuthHosts   []string
+	// UseNetrc enables Basic authentication from NetrcFile (default: ~/.netrc).
+	// The default entry is only used for the hosts that receive authentication.
+	UseNetrc  bool
+	NetrcFile string
+	netrc     map[string]netrcEntry
+	origin    *url.URL
+
+	// Rewrite rules are applied in order to all request URLs after
+	// resolving them. The original URLs are kept in the metadata.
+	Rewrite []RewriteRule
 
+	Redirect RedirectPolicy
+
+	// DisableConditionalReload disables If-None-Match/If-Modified-Since
+	// for playlist reloads.
+	DisableConditionalReload bool
+
+	// StallTimeout is the number of target durations without progress in
+	// the playlist (new segments, program date time, or a media sequence
+	// that stays the same while the playlist grows past its usual size)
+	// after which the StallActions are run (0 = disabled).
+	StallTimeout float64
+	StallActions []string
+	StallCommand string
+
+	// PropagateQuery selects query parameters of the master playlist URL
+	// that are added to all URLs derived from it (QueryAll for all of them).
+	PropagateQuery []string
+
+	// MasterReload is the interval for reloading the master playlist to
+	// start streams for new variants and end the ones of removed variants.
+	MasterReload time.Duration
+	renditions   []string
+	languages    map[string]string
+
+	mu      sync.Mutex
+	index   int
 	streams []*stream
 	stop    bool
 }
@@ -39,11 +151,20 @@ func (s *stream) dump() (err error) {
 	s.output.queue.c = make(chan *segment, 64)
 	s.output.queue.sequence = -1
 
-	if s.playlist.file, err = createFileWriteOnly(s.name + ".m3u8"); err != nil {
+	s.playlist.name = s.playlistName()
+	if s.playlist.file, err = s.d.outputStorage().Create(s.playlist.name); err != nil {
 		log.Println("Failed to create playlist file", err)
 		return
 	}
-	defer s.playlist.file.Close()
+	defer func() {
+		// The playlist is stored (e.g. uploaded) when it is closed
+		if cerr := s.playlist.file.Close(); cerr != nil {
+			log.Println("Failed to close playlist file:", cerr)
+			if err == nil {
+				err = cerr
+			}
+		}
+	}()
 
 	go s.playlistWorker()
 	err = s.downloadWorker()
@@ -65,19 +186,70 @@ func (s *stream) start(wg *sync.WaitGroup, erro *error) {
 	if err := s.dump(); *erro == nil {
 		*erro = err
 	}
+
+	s.d.mu.Lock()
+	s.ended = true
+	s.d.mu.Unlock()
 }
 
 func (d *Dumper) startAll() (err error) {
 	var wg sync.WaitGroup
+	d.mu.Lock()
 	wg.Add(len(d.streams))
 	for _, s := range d.streams {
 		go s.start(&wg, &err)
 	}
+	d.mu.Unlock()
+
+	if d.MasterReload > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go d.masterLoop(&wg, &err, done)
+	}
+
 	wg.Wait()
 	return
 }
 
 func (d *Dumper) Start() (err error) {
+	if err = d.initTransport(); err != nil {
+		log.Println("Failed to set up HTTP transport:", err)
+		return
+	}
+	defer d.saveCookies()
+
+	d.initStorage()
+	defer d.closeStorage()
+
+	if d.origin, err = url.Parse(d.URL); err != nil {
+		log.Println("Invalid URL:", err)
+		return
+	}
+	if d.UseNetrc {
+		if d.netrc, err = readNetrc(d.NetrcFile); err != nil {
+			log.Println("Failed to read .netrc:", err)
+			return
+		}
+	}
+
+	if err = d.openMetadata(); err != nil {
+		log.Println("Failed to create metadata file:", err)
+		return
+	}
+	defer d.closeMetadata()
+
+	if err = d.openHTTPLog(); err != nil {
+		log.Println("Failed to create HTTP log:", err)
+		return
+	}
+	defer d.closeHTTPLog()
+
+	if err = d.openWARC(); err != nil {
+		log.Println("Failed to create WARC file:", err)
+		return
+	}
+	defer d.closeWARC()
+
 	if err = d.loadMaster(); err != nil {
 		log.Println("Failed to load master playlist", err)
 		return
@@ -88,6 +260,10 @@ func (d *Dumper) Start() (err error) {
 		err = errNoStreamsFound
 		log.Println(err)
 	case 1:
+		if d.MasterReload > 0 {
+			err = d.startAll()
+			break
+		}
 		// Start directly
 		err = d.streams[0].dump()
 	default:
@@ -97,7 +273,17 @@ func (d *Dumper) Start() (err error) {
 	return
 }
 
+func (d *Dumper) saveCookies() {
+	if jar, ok := d.Jar.(*CookieJar); ok && d.SaveCookies != "" {
+		if err := jar.Save(d.SaveCookies); err != nil {
+			log.Println("Failed to save cookies:", err)
+		}
+	}
+}
+
 func (d *Dumper) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	for _, s := range d.streams {
 		s.playlist.active = false
 	}
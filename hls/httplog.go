@@ -0,0 +1,325 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exchangeTimings are in milliseconds, -1 if they do not apply
+// (e.g. DNS and connect for reused connections).
+type exchangeTimings struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	TLS     float64 `json:"tls"`
+	TTFB    float64 `json:"ttfb"`
+	Total   float64 `json:"total"`
+}
+
+type exchange struct {
+	Time       time.Time       `json:"time"`
+	Stream     string          `json:"stream,omitempty"`
+	Type       string          `json:"type"`
+	Sequence   *int            `json:"sequence,omitempty"`
+	Retry      int             `json:"retry"`
+	Method     string          `json:"method"`
+	URL        string          `json:"url"`
+	Request    http.Header     `json:"request_headers"`
+	Proto      string          `json:"proto,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	StatusText string          `json:"status_text,omitempty"`
+	Response   http.Header     `json:"response_headers,omitempty"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Bytes      int64           `json:"bytes"`
+	Timings    exchangeTimings `json:"timings"`
+	Error      string          `json:"error,omitempty"`
+
+	mu sync.Mutex
+	t  exchangeTimes
+}
+
+type exchangeTimes struct {
+	dns, dnsDone, connect, connectDone, tls, tlsDone, firstByte time.Time
+}
+
+// httpLog records all HTTP exchanges as JSON lines or as HAR 1.2 if the
+// file name ends with .har. HAR entries are written as they finish, the
+// closing brackets are added when the log is closed.
+type httpLog struct {
+	mu      sync.Mutex
+	f       File
+	w       *bufio.Writer
+	har     bool
+	entries int
+}
+
+func (d *Dumper) openHTTPLog() (err error) {
+	if d.HTTPLog == "" {
+		return
+	}
+
+	f, err := d.Storage.Create(d.HTTPLog)
+	if err != nil {
+		return
+	}
+	d.httpLog = &httpLog{
+		f:   f,
+		w:   bufio.NewWriter(f),
+		har: strings.EqualFold(filepath.Ext(d.HTTPLog), ".har"),
+	}
+	if d.httpLog.har {
+		_, err = d.httpLog.w.WriteString(`{"log":{"version":"1.2","creator":{"name":"hlsdump","version":"1"},"entries":[` + "\n")
+	}
+	return
+}
+
+func (d *Dumper) closeHTTPLog() {
+	l := d.httpLog
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.har {
+		l.w.WriteString("]}}\n")
+	}
+	err := l.w.Flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Failed to close HTTP log:", err)
+	}
+}
+
+func (l *httpLog) write(ex *exchange) {
+	var v interface{} = ex
+	if l.har {
+		v = ex.harEntry()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Failed to encode HTTP log entry:", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.har && l.entries > 0 {
+		l.w.WriteString(",\n")
+	}
+	l.entries++
+	l.w.Write(b)
+	if !l.har {
+		l.w.WriteByte('\n')
+	}
+	if err = l.w.Flush(); err != nil {
+		log.Println("Failed to write HTTP log:", err)
+	}
+}
+
+func newExchange(rec *metadataRecord, req *http.Request) *exchange {
+	ex := &exchange{
+		Time:     time.Now(),
+		Stream:   rec.Stream,
+		Type:     rec.Type,
+		Sequence: rec.Sequence,
+		Retry:    rec.Retry,
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Request:  redactHeaders(req.Header),
+	}
+	return ex
+}
+
+func (ex *exchange) now(t *time.Time) {
+	ex.mu.Lock()
+	*t = time.Now()
+	ex.mu.Unlock()
+}
+
+// trace adds the hooks for the timings to the trace.
+func (ex *exchange) trace(trace *httptrace.ClientTrace) {
+	trace.DNSStart = func(httptrace.DNSStartInfo) { ex.now(&ex.t.dns) }
+	trace.DNSDone = func(httptrace.DNSDoneInfo) { ex.now(&ex.t.dnsDone) }
+	trace.ConnectStart = func(string, string) { ex.now(&ex.t.connect) }
+	trace.ConnectDone = func(string, string, error) { ex.now(&ex.t.connectDone) }
+	trace.TLSHandshakeStart = func() { ex.now(&ex.t.tls) }
+	trace.TLSHandshakeDone = func(tls.ConnectionState, error) { ex.now(&ex.t.tlsDone) }
+	trace.GotFirstResponseByte = func() { ex.now(&ex.t.firstByte) }
+}
+
+func millis(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return -1
+	}
+	return float64(end.Sub(start)) / float64(time.Millisecond)
+}
+
+func (ex *exchange) finish(l *httpLog, err error) {
+	ex.mu.Lock()
+	end := time.Now()
+	ex.Timings = exchangeTimings{
+		DNS:     millis(ex.t.dns, ex.t.dnsDone),
+		Connect: millis(ex.t.connect, ex.t.connectDone),
+		TLS:     millis(ex.t.tls, ex.t.tlsDone),
+		TTFB:    millis(ex.Time, ex.t.firstByte),
+		Total:   millis(ex.Time, end),
+	}
+	if err != nil && err != io.EOF {
+		ex.Error = err.Error()
+	}
+	ex.mu.Unlock()
+
+	l.write(ex)
+}
+
+// redirect finishes the exchange with the redirect response of req
+// and resets it for req, the request to the redirect target.
+func (ex *exchange) redirect(l *httpLog, req *http.Request, remoteAddr string) {
+	ex.setResponse(req.Response, remoteAddr)
+	ex.finish(l, nil)
+
+	ex.mu.Lock()
+	ex.Time = time.Now()
+	ex.Method = req.Method
+	ex.URL = req.URL.String()
+	ex.Request = redactHeaders(req.Header)
+	ex.Proto, ex.Status, ex.StatusText, ex.Response, ex.RemoteAddr = "", 0, "", nil, ""
+	ex.Bytes = 0
+	ex.Timings = exchangeTimings{}
+	ex.t = exchangeTimes{}
+	ex.mu.Unlock()
+}
+
+func (ex *exchange) setResponse(resp *http.Response, remoteAddr string) {
+	ex.Proto = resp.Proto
+	ex.Status = resp.StatusCode
+	ex.StatusText = http.StatusText(resp.StatusCode)
+	ex.Response = resp.Header
+	ex.RemoteAddr = remoteAddr
+}
+
+// loggedBody counts the bytes of the response body and finishes the
+// exchange when the body is closed.
+type loggedBody struct {
+	io.ReadCloser
+	l    *httpLog
+	ex   *exchange
+	err  error
+	once sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.ex.Bytes += int64(n)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.ex.finish(b.l, b.err) })
+	return err
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func harHeaders(h http.Header) []harHeader {
+	headers := []harHeader{}
+	for k, vs := range h {
+		for _, v := range vs {
+			headers = append(headers, harHeader{k, v})
+		}
+	}
+	return headers
+}
+
+// harEntry converts the exchange to an entry of a HAR 1.2 log.
+func (ex *exchange) harEntry() map[string]interface{} {
+	// The connect time includes the TLS handshake in HAR
+	connect := ex.Timings.Connect
+	if connect >= 0 && ex.Timings.TLS > 0 {
+		connect += ex.Timings.TLS
+	}
+	// send, wait and receive are required, so they are never -1.
+	// Failed requests without a response spend all of the time waiting.
+	wait, receive := ex.Timings.Total, 0.0
+	if ex.Timings.TTFB >= 0 {
+		wait, receive = ex.Timings.TTFB, ex.Timings.Total-ex.Timings.TTFB
+	}
+	for _, t := range []float64{ex.Timings.DNS, connect} {
+		if t > 0 {
+			wait -= t
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+
+	response := map[string]interface{}{
+		"status":      ex.Status,
+		"statusText":  ex.StatusText,
+		"httpVersion": ex.Proto,
+		"headers":     harHeaders(ex.Response),
+		"cookies":     []interface{}{},
+		"content":     map[string]interface{}{"size": ex.Bytes, "mimeType": ex.Response.Get("Content-Type")},
+		"redirectURL": ex.Response.Get("Location"),
+		"headersSize": -1,
+		"bodySize":    ex.Bytes,
+	}
+	if ex.Error != "" {
+		response["_error"] = ex.Error
+	}
+
+	entry := map[string]interface{}{
+		"startedDateTime": ex.Time.Format(time.RFC3339Nano),
+		"time":            ex.Timings.Total,
+		"request": map[string]interface{}{
+			"method":      ex.Method,
+			"url":         ex.URL,
+			"httpVersion": ex.Proto,
+			"headers":     harHeaders(ex.Request),
+			"queryString": []interface{}{},
+			"cookies":     []interface{}{},
+			"headersSize": -1,
+			"bodySize":    0,
+		},
+		"response": response,
+		"cache":    map[string]interface{}{},
+		"timings": map[string]interface{}{
+			"blocked": -1,
+			"dns":     ex.Timings.DNS,
+			"connect": connect,
+			"ssl":     ex.Timings.TLS,
+			"send":    0,
+			"wait":    wait,
+			"receive": receive,
+		},
+		"_stream":   ex.Stream,
+		"_type":     ex.Type,
+		"_sequence": ex.Sequence,
+		"_retry":    ex.Retry,
+	}
+	if host, _, err := net.SplitHostPort(ex.RemoteAddr); err == nil {
+		entry["serverIPAddress"] = host
+	}
+	return entry
+}
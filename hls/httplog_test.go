@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHAREntryTimings(t *testing.T) {
+	tests := []struct {
+		timings       exchangeTimings
+		wait, receive float64
+	}{
+		{exchangeTimings{DNS: 1, Connect: 2, TLS: 3, TTFB: 10, Total: 15}, 4, 5},
+		{exchangeTimings{DNS: -1, Connect: -1, TLS: -1, TTFB: 10, Total: 15}, 10, 5},
+		{exchangeTimings{DNS: -1, Connect: -1, TLS: -1, TTFB: -1, Total: 30}, 30, 0},
+		{exchangeTimings{DNS: 5, Connect: -1, TLS: -1, TTFB: -1, Total: 5}, 0, 0},
+		{exchangeTimings{DNS: 1, Connect: 2, TLS: 3, TTFB: -1, Total: 4}, 0, 0},
+	}
+
+	for _, test := range tests {
+		ex := &exchange{Timings: test.timings}
+		timings := ex.harEntry()["timings"].(map[string]interface{})
+		if timings["send"] != 0 || timings["wait"] != test.wait || timings["receive"] != test.receive {
+			t.Errorf("HAR timings for %+v = %v, want wait %v, receive %v",
+				test.timings, timings, test.wait, test.receive)
+		}
+	}
+}
+
+func TestHTTPLogRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.m3u8":
+			http.Redirect(w, r, "/b.m3u8", http.StatusFound)
+		case "/b.m3u8":
+			http.Redirect(w, r, "/c.m3u8", http.StatusMovedPermanently)
+		default:
+			_, _ = w.Write([]byte("#EXTM3U\n"))
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Dumper{Storage: DirStorage{Dir: dir}, HTTPLog: "test.jsonl", RoundTripper: http.DefaultTransport}
+	if err = d.openHTTPLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		redirects int
+		entries   []string
+		err       bool
+	}{
+		{0, []string{"302 /a.m3u8", "301 /b.m3u8", "200 /c.m3u8"}, false},
+		{2, []string{"302 /a.m3u8", "301 /b.m3u8"}, true},
+		{-1, []string{"302 /a.m3u8"}, false},
+	}
+	var want []string
+	for _, test := range tests {
+		d.Redirect.MaxRedirects = test.redirects
+		req, err := d.newRequest(srv.URL + "/a.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := d.newClient(0)
+		resp, err := d.do(&client, req, &metadataRecord{Type: RequestMaster})
+		if (err != nil) != test.err {
+			t.Fatalf("request with %d redirects returned error %v", test.redirects, err)
+		}
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		want = append(want, test.entries...)
+	}
+	d.closeHTTPLog()
+
+	f, err := os.Open(filepath.Join(dir, "test.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []string
+	for dec := json.NewDecoder(f); ; {
+		var ex struct {
+			URL    string `json:"url"`
+			Status int    `json:"status"`
+		}
+		if err = dec.Decode(&ex); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, fmt.Sprintf("%d %s", ex.Status, strings.TrimPrefix(ex.URL, srv.URL)))
+	}
+	if strings.Join(entries, ", ") != strings.Join(want, ", ") {
+		t.Errorf("logged exchanges %v, want %v", entries, want)
+	}
+}
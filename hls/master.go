@@ -57,7 +57,15 @@ func (d *Dumper) matchRenditions(attr map[string]string) bool {
 		contains(d.Groups, attr["SUBTITLES"]) || contains(d.Groups, attr["CLOSED-CAPTIONS"])
 }
 
-func (d *Dumper) parseMaster(masterURL *url.URL, scanner *bufio.Scanner) (err error) {
+type variant struct {
+	url  *url.URL
+	attr map[string]string
+}
+
+// parseMaster returns the matching variants of a master playlist.
+// If the playlist is a media playlist, media is set instead. The variant URIs
+// are resolved against masterURL and the parameters from query are propagated.
+func (d *Dumper) parseMaster(masterURL *url.URL, query url.Values, scanner *bufio.Scanner) (variants []*variant, media bool, err error) {
 	if !scanner.Scan() {
 		err = eofIfNil(scanner.Err())
 		return
@@ -69,8 +77,7 @@ func (d *Dumper) parseMaster(masterURL *url.URL, scanner *bufio.Scanner) (err er
 		return
 	}
 
-	matchedStream := false
-	i := 0
+	var matched map[string]string
 
 	for scanner.Scan() {
 		line = scanner.Text()
@@ -101,23 +108,16 @@ func (d *Dumper) parseMaster(masterURL *url.URL, scanner *bufio.Scanner) (err er
 				}
 
 				if d.matchRenditions(attr) {
-					matchedStream = true
+					matched = attr
 				}
 			default:
-				_, media := mediaTags[k]
-				_, segment := segmentTags[k]
-				if media || segment {
-					if len(d.streams) > 0 {
+				_, mediaTag := mediaTags[k]
+				_, segmentTag := segmentTags[k]
+				if mediaTag || segmentTag {
+					if len(variants) > 0 {
 						err = errMixedPlaylist
-						return
 					}
-
-					s := &stream{
-						d:    d,
-						name: d.Name,
-					}
-					s.playlist.url = masterURL
-					d.streams = []*stream{s}
+					media = true
 					return
 				}
 			}
@@ -130,72 +130,123 @@ func (d *Dumper) parseMaster(masterURL *url.URL, scanner *bufio.Scanner) (err er
 			continue
 		}
 
-		if matchedStream {
-			i++
-			matchedStream = false
-
-			s := &stream{
-				d:    d,
-				name: fmt.Sprintf("%s-%d", d.Name, i),
-			}
-			s.playlist.url, err = masterURL.Parse(line)
-			if err != nil {
+		if matched != nil {
+			v := &variant{attr: matched}
+			if v.url, err = d.resolveURL(masterURL, line, query); err != nil {
 				return
 			}
 
-			log.Println("Downloading stream:", s.playlist.url)
-			d.streams = append(d.streams, s)
+			variants = append(variants, v)
+			matched = nil
 		}
 	}
 
 	return
 }
 
-func (d *Dumper) fetchMaster() (masterURL *url.URL, b []byte, err error) {
-	req, err := d.newRequest(d.URL)
+// fetchMaster returns the master playlist and its URL after redirects.
+// query is taken from the requested URL instead, since redirects (e.g. to a
+// CDN) often drop the parameters that should be propagated.
+func (d *Dumper) fetchMaster(u string) (masterURL *url.URL, query url.Values, b []byte, err error) {
+	req, err := d.newRequest(u)
 	if err != nil {
 		return
 	}
 	masterURL = req.URL
+	query = req.URL.Query()
 
-	client := http.Client{
-		Timeout: d.PlaylistTimeout,
-	}
-	resp, err := client.Do(req)
+	client := d.newClient(d.PlaylistTimeout)
+	resp, err := d.do(&client, req, &metadataRecord{Type: RequestMaster})
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
+	if d.Verbose {
+		logTLS(resp)
+	}
+	if u := redirectedURL(resp); u != nil {
+		log.Println("Master playlist redirected to", u)
+		masterURL = u
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		err = httpResponseStatusError(resp)
 		return
 	}
 
 	b, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
+	return
+}
+
+func (d *Dumper) writeMaster(masterURL *url.URL, query url.Values, b []byte) (err error) {
+	if d.Mirror {
+		name := d.mirrorPath(masterURL, query)
+		return writeFile(d.outputStorage(), name, d.mirrorPlaylist(masterURL, query, name, b))
 	}
 
 	// TODO: Replace names in playlist
-	f, err := createFileWriteOnly(d.Name + ".m3u8")
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	_, err = f.Write(b)
-	return
+	return writeFile(d.outputStorage(), d.Name+".m3u8", b)
 }
 
 func (d *Dumper) loadMaster() (err error) {
-	masterURL, b, err := d.fetchMaster()
+	masterURL, query, b, err := d.fetchMaster(d.URL)
 	if err != nil {
 		return
 	}
 
-	err = d.parseMaster(masterURL, bufio.NewScanner(bytes.NewReader(b)))
+	variants, media, err := d.parseMaster(masterURL, query, bufio.NewScanner(bytes.NewReader(b)))
 	if err != nil {
 		return
 	}
+
+	// The mirrored media playlist is written by its stream
+	if !media || !d.Mirror {
+		if err = d.writeMaster(masterURL, query, b); err != nil {
+			return
+		}
+	}
+
+	if media {
+		s := &stream{
+			d:     d,
+			name:  d.Name,
+			query: query,
+		}
+		s.playlist.url = masterURL
+		if !d.Redirect.Reuse {
+			// Reload from the original URL, relative URIs are resolved
+			// against the redirected URL when the playlist is fetched.
+			s.playlist.url = d.origin
+		}
+		d.streams = []*stream{s}
+		// There are no variants that could change
+		d.MasterReload = 0
+		return
+	}
+
+	d.renditions = parseRenditions(b)
+	d.languages = audioLanguages(b)
+	keys := variantKeys(variants)
+	for i, v := range variants {
+		s := d.newStream(v, keys[i], query)
+		log.Println("Downloading stream:", s.playlist.url)
+		d.streams = append(d.streams, s)
+	}
 	return
 }
+
+func (d *Dumper) newStream(v *variant, key string, query url.Values) *stream {
+	d.index++
+	s := &stream{
+		d:        d,
+		name:     fmt.Sprintf("%s-%d", d.Name, d.index),
+		index:    d.index,
+		attr:     v.attr,
+		language: d.languages[v.attr["AUDIO"]],
+		key:      key,
+		query:    query,
+	}
+	s.playlist.url = v.url
+	return s
+}
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchMasterRedirectQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/master.m3u8" {
+			// The CDN URL does not contain the token anymore
+			http.Redirect(w, r, "/cdn/master.m3u8", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nv1.m3u8\n")
+	}))
+	defer srv.Close()
+
+	d := &Dumper{PropagateQuery: []string{"token"}, RoundTripper: http.DefaultTransport}
+	masterURL, query, b, err := d.fetchMaster(srv.URL + "/master.m3u8?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterURL.String() != srv.URL+"/cdn/master.m3u8" {
+		t.Errorf("master URL = %s", masterURL)
+	}
+
+	variants, _, err := d.parseMaster(masterURL, query, bufio.NewScanner(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 1 {
+		t.Fatalf("found %d variants, want 1", len(variants))
+	}
+	if u := variants[0].url.String(); u != srv.URL+"/cdn/v1.m3u8?token=abc" {
+		t.Errorf("variant URL = %s", u)
+	}
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const recordReload = "reload"
+
+type metadataRecord struct {
+	Time     time.Time `json:"time"`
+	Stream   string    `json:"stream,omitempty"`
+	Type     string    `json:"type"`
+	Sequence *int      `json:"sequence,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Retry    int       `json:"retry,omitempty"`
+
+	URL          string `json:"url,omitempty"`
+	OriginalURL  string `json:"original_url,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	Age          string `json:"age,omitempty"`
+	CacheControl string `json:"cache_control,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Playlist reload timing in seconds
+	Scheduled float64 `json:"scheduled,omitempty"`
+	Actual    float64 `json:"actual,omitempty"`
+	Changed   *bool   `json:"changed,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type metadata struct {
+	mu  sync.Mutex
+	f   File
+	enc *json.Encoder
+}
+
+func (d *Dumper) openMetadata() (err error) {
+	if !d.Metadata {
+		return
+	}
+
+	f, err := d.Storage.Create(d.Name + "-metadata.jsonl")
+	if err != nil {
+		return
+	}
+	d.metadata.f = f
+	d.metadata.enc = json.NewEncoder(f)
+	return
+}
+
+func (d *Dumper) closeMetadata() {
+	if d.metadata.f != nil {
+		if err := d.metadata.f.Close(); err != nil {
+			log.Println("Failed to close metadata:", err)
+		}
+	}
+}
+
+func (d *Dumper) record(rec *metadataRecord) {
+	if d.metadata.enc == nil {
+		return
+	}
+
+	d.metadata.mu.Lock()
+	defer d.metadata.mu.Unlock()
+	if err := d.metadata.enc.Encode(rec); err != nil {
+		log.Println("Failed to write metadata:", err)
+	}
+}
+
+func (s *stream) newRecord(typ string, seg *segment) *metadataRecord {
+	rec := &metadataRecord{
+		Stream: s.name,
+		Type:   typ,
+	}
+	if seg != nil {
+		rec.Sequence = &seg.sequence
+		rec.Retry = seg.retries
+	}
+	return rec
+}
+
+// do performs the request with the configured headers and records it in the
+// metadata, including the address of the server that answered it.
+func (d *Dumper) do(client *http.Client, req *http.Request, rec *metadataRecord) (resp *http.Response, err error) {
+	original := req.URL
+	if req, err = d.prepareRequest(req, rec.Type); err != nil {
+		return
+	}
+	if d.metadata.enc == nil && d.httpLog == nil && d.warc == nil {
+		return client.Do(req)
+	}
+
+	rec.Time = time.Now()
+	rec.URL = req.URL.String()
+	if req.URL != original {
+		rec.OriginalURL = original.String()
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			rec.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}
+	var ex *exchange
+	if d.httpLog != nil {
+		ex = newExchange(rec, req)
+		ex.trace(trace)
+
+		// Log each redirect as its own exchange
+		c := *client
+		check := client.CheckRedirect
+		if check == nil {
+			check = d.Redirect.check
+		}
+		c.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+			err := check(next, via)
+			if err == nil {
+				ex.redirect(d.httpLog, next, rec.RemoteAddr)
+			} else if err != http.ErrUseLastResponse {
+				ex.setResponse(next.Response, rec.RemoteAddr)
+			}
+			return err
+		}
+		client = &c
+	}
+
+	resp, err = client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if d.warc != nil && err == nil {
+		resp.Body = d.warc.newBody(resp, rec.RemoteAddr)
+	}
+	if ex != nil {
+		if err != nil {
+			ex.finish(d.httpLog, err)
+		} else {
+			ex.setResponse(resp, rec.RemoteAddr)
+			resp.Body = &loggedBody{ReadCloser: resp.Body, l: d.httpLog, ex: ex}
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	} else {
+		rec.Status = resp.StatusCode
+		rec.Age = resp.Header.Get("Age")
+		rec.CacheControl = resp.Header.Get("Cache-Control")
+		rec.ETag = resp.Header.Get("ETag")
+		rec.LastModified = resp.Header.Get("Last-Modified")
+	}
+	d.record(rec)
+	return
+}
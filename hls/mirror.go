@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// resource is a file referenced by a EXT-X-KEY or EXT-X-MAP tag.
+// length is -1 if the whole file is used.
+type resource struct {
+	kind   string
+	uri    string
+	length int64
+	offset int64
+}
+
+var uriAttributePattern = regexp.MustCompile(`URI="([^"]*)"`)
+
+// mirrorPath returns the path of the URL in the mirror layout (host/path).
+// A hash of the query is added to the file name, so resources that only
+// differ by query are stored separately. The parameters that were propagated
+// from query are ignored for that.
+func (d *Dumper) mirrorPath(u *url.URL, query url.Values) string {
+	p := path.Clean("/" + u.Path)
+	if p == "/" || strings.HasSuffix(u.Path, "/") {
+		p = path.Join(p, "index")
+	}
+	if q := d.mirrorQuery(u, query); q != "" {
+		sum := sha1.Sum([]byte(q))
+		ext := path.Ext(p)
+		p = fmt.Sprintf("%s_%x%s", strings.TrimSuffix(p, ext), sum[:6], ext)
+	}
+	return mirrorHost(u.Host) + p
+}
+
+// mirrorHost returns the directory for the host. Hosts that could escape
+// the output directory (e.g. from //../x.ts) are escaped.
+func mirrorHost(host string) string {
+	host = templateReplacer.Replace(host)
+	if host == "" || host == "." || host == ".." {
+		return "_" + host
+	}
+	return host
+}
+
+// mirrorQuery returns the query of the URL without the parameters that
+// were propagated from query.
+func (d *Dumper) mirrorQuery(u *url.URL, query url.Values) string {
+	if len(d.PropagateQuery) == 0 || len(query) == 0 {
+		return u.RawQuery
+	}
+
+	var params []string
+	for _, p := range strings.Split(u.RawQuery, "&") {
+		k, v := splitPair(p, '=')
+		k, _ = url.QueryUnescape(k)
+		v, _ = url.QueryUnescape(v)
+		if (contains(d.PropagateQuery, QueryAll) || contains(d.PropagateQuery, k)) && contains(query[k], v) {
+			continue
+		}
+		params = append(params, p)
+	}
+	return strings.Join(params, "&")
+}
+
+// mirrorReference returns the reference to use in the mirrored file from.
+// It is resolved against base (the possibly redirected URL of the file) and
+// replaced by the relative path to the mirrored file. URIs that are not
+// downloaded (e.g. skd:// keys) are kept.
+func (d *Dumper) mirrorReference(base *url.URL, query url.Values, from, ref string) string {
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ref
+	}
+	return relativeName(from, d.mirrorPath(u, query))
+}
+
+// mirrorLine rewrites the URI of a playlist line or the URI attribute of a tag.
+func (d *Dumper) mirrorLine(base *url.URL, query url.Values, from, line string) string {
+	if line == "" {
+		return line
+	}
+	if line[0] != '#' {
+		return d.mirrorReference(base, query, from, line)
+	}
+	return uriAttributePattern.ReplaceAllStringFunc(line, func(m string) string {
+		return `URI="` + d.mirrorReference(base, query, from, m[5:len(m)-1]) + `"`
+	})
+}
+
+// mirrorPlaylist rewrites all URIs of a playlist stored at from.
+func (d *Dumper) mirrorPlaylist(base *url.URL, query url.Values, from string, b []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		_ = writeLine(&out, d.mirrorLine(base, query, from, scanner.Text()))
+	}
+	return out.Bytes()
+}
+
+// parseResource returns the file referenced by a EXT-X-KEY or EXT-X-MAP tag.
+func parseResource(tag, value string) (r *resource, err error) {
+	attr := parseAttributeList(value)
+	if attr == nil {
+		err = errInvalidAttributeList
+		return
+	}
+	if attr["URI"] == "" || attr["METHOD"] == "NONE" {
+		return
+	}
+
+	r = &resource{kind: RequestSegment, uri: attr["URI"], length: -1}
+	if tag == "EXT-X-KEY" {
+		r.kind = RequestKey
+	}
+	if br, ok := attr["BYTERANGE"]; ok {
+		l, o := splitPair(br, '@')
+		if r.length, err = strconv.ParseInt(l, 10, 64); err != nil {
+			return
+		}
+		// The offset of EXT-X-MAP defaults to 0
+		if o != "" {
+			if r.offset, err = strconv.ParseInt(o, 10, 64); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *stream) baseURL() *url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.playlist.base != nil {
+		return s.playlist.base
+	}
+	return s.playlist.url
+}
+
+// mirrorRange is set if the segment is written to its offset in the
+// mirrored file instead of a file of its own.
+func (s *stream) mirrorRange(seg *segment) bool {
+	return s.d.Mirror && seg.length > 0 && seg.offset >= 0
+}
+
+// rangeFile returns the open mirrored file for byte range segments.
+// The files are kept open until the stream ends.
+func (s *stream) rangeFile(name string) (f File, err error) {
+	if f = s.output.rangeFiles[name]; f != nil {
+		return
+	}
+	if f, err = s.d.outputStorage().Create(name); err != nil {
+		return
+	}
+	if s.output.rangeFiles == nil {
+		s.output.rangeFiles = make(map[string]File)
+	}
+	s.output.rangeFiles[name] = f
+	return
+}
+
+func (s *stream) closeRangeFiles(erro *error) {
+	for name, f := range s.output.rangeFiles {
+		if err := f.Close(); err != nil {
+			log.Println("Failed to close", name+":", err)
+			if *erro == nil {
+				*erro = err
+			}
+		}
+	}
+	s.output.rangeFiles = nil
+}
+
+// saveResources stores the keys and init sections used by the segment
+// if they were not stored before.
+func (s *stream) saveResources(seg *segment) {
+	for _, r := range seg.resources {
+		u, err := s.resolve(r.uri)
+		if err != nil {
+			log.Println("Invalid URI:", err)
+			continue
+		}
+
+		id := fmt.Sprintf("%s@%d-%d", u, r.offset, r.length)
+		if s.output.resources[id] {
+			continue
+		}
+		if err = s.saveResource(r, u); err != nil {
+			log.Println("Failed to save", r.uri+":", err)
+			continue
+		}
+
+		if s.output.resources == nil {
+			s.output.resources = make(map[string]bool)
+		}
+		s.output.resources[id] = true
+	}
+}
+
+func (s *stream) saveResource(r *resource, u *url.URL) (err error) {
+	req, err := s.d.newRequest(u.String())
+	if err != nil {
+		return
+	}
+	expectedStatus := http.StatusOK
+	if r.length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.length-1))
+		expectedStatus = http.StatusPartialContent
+	}
+
+	s.output.client.Timeout = s.d.playlistTimeout()
+	resp, err := s.d.do(&s.output.client, req, s.newRecord(r.kind, nil))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		err = httpResponseStatusError(resp)
+		return
+	}
+
+	name := s.d.mirrorPath(u, s.query)
+	if r.length < 0 {
+		f, err := s.d.outputStorage().Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(f, resp.Body); err != nil {
+			_ = f.Abort()
+			return err
+		}
+		return f.Close()
+	}
+
+	if err = checkContentRange(resp, r.offset, r.offset+r.length-1); err != nil {
+		return
+	}
+	f, err := s.rangeFile(name)
+	if err != nil {
+		return
+	}
+	if _, err = f.Seek(r.offset, io.SeekStart); err != nil {
+		return
+	}
+	_, err = io.CopyN(f, resp.Body, r.length)
+	return
+}
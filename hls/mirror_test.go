@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMirrorPath(t *testing.T) {
+	d := &Dumper{PropagateQuery: []string{"token"}}
+	query := url.Values{"token": {"abc"}}
+
+	name := func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.mirrorPath(u, query)
+	}
+
+	if got := name("http://example.com/a/../b/seg.ts"); got != "example.com/b/seg.ts" {
+		t.Errorf("mirrorPath = %q", got)
+	}
+	if got := name("http://example.com/live/"); got != "example.com/live/index" {
+		t.Errorf("mirrorPath = %q", got)
+	}
+
+	// Hosts must not escape the output directory
+	for _, test := range []struct{ url, want string }{
+		{"http://../x.ts", "_../x.ts"},
+		{"//../x.ts", "_../x.ts"},
+		{"http://./x.ts", "_./x.ts"},
+		{"file:///x.ts", "_/x.ts"},
+	} {
+		if got := name(test.url); got != test.want {
+			t.Errorf("mirrorPath(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+
+	part1 := name("http://example.com/seg.ts?part=1")
+	part2 := name("http://example.com/seg.ts?part=2")
+	if part1 == part2 || part1 == "example.com/seg.ts" {
+		t.Errorf("query is not encoded: %q, %q", part1, part2)
+	}
+	if !strings.HasPrefix(part1, "example.com/seg_") || !strings.HasSuffix(part1, ".ts") {
+		t.Errorf("mirrorPath = %q", part1)
+	}
+
+	// Propagated parameters do not change the name
+	if got := name("http://example.com/seg.ts?part=1&token=abc"); got != part1 {
+		t.Errorf("mirrorPath with propagated token = %q, want %q", got, part1)
+	}
+	if got := name("http://example.com/seg.ts?token=abc"); got != "example.com/seg.ts" {
+		t.Errorf("mirrorPath with propagated token = %q", got)
+	}
+	if got := name("http://example.com/seg.ts?token=other"); got == "example.com/seg.ts" {
+		t.Errorf("mirrorPath ignored token that was not propagated: %q", got)
+	}
+}
+
+func TestMirrorReference(t *testing.T) {
+	d := &Dumper{}
+	// The playlist was stored at origin.test, but redirected to cdn.test
+	from := "origin.test/live/video.m3u8"
+	base, _ := url.Parse("http://cdn.test/v1/video.m3u8")
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"seg1.ts", "../../cdn.test/v1/seg1.ts"},
+		{"/v2/seg1.ts", "../../cdn.test/v2/seg1.ts"},
+		{"http://other.test/seg1.ts", "../../other.test/seg1.ts"},
+		{"skd://key", "skd://key"},
+	}
+	for _, test := range tests {
+		if got := d.mirrorReference(base, nil, from, test.ref); got != test.want {
+			t.Errorf("mirrorReference(%q) = %q, want %q", test.ref, got, test.want)
+		}
+	}
+
+	// Without redirect, relative references stay the same
+	base, _ = url.Parse("http://origin.test/live/video.m3u8")
+	if got := d.mirrorReference(base, nil, from, "seg1.ts"); got != "seg1.ts" {
+		t.Errorf("mirrorReference = %q, want seg1.ts", got)
+	}
+
+	line := `#EXT-X-MAP:URI="init.mp4",BYTERANGE="100"`
+	want := `#EXT-X-MAP:URI="../../cdn.test/v1/init.mp4",BYTERANGE="100"`
+	base, _ = url.Parse("http://cdn.test/v1/video.m3u8")
+	if got := d.mirrorLine(base, nil, from, line); got != want {
+		t.Errorf("mirrorLine = %q, want %q", got, want)
+	}
+}
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		tag, value     string
+		length, offset int64
+		err            bool
+	}{
+		{"EXT-X-MAP", `URI="init.mp4"`, -1, 0, false},
+		{"EXT-X-MAP", `URI="init.mp4",BYTERANGE="100@50"`, 100, 50, false},
+		{"EXT-X-MAP", `URI="init.mp4",BYTERANGE="100"`, 100, 0, false},
+		{"EXT-X-MAP", `URI="init.mp4",BYTERANGE="x"`, 0, 0, true},
+		{"EXT-X-MAP", `URI="init.mp4",BYTERANGE="100@x"`, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		r, err := parseResource(test.tag, test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseResource(%q) returned error %v", test.value, err)
+			continue
+		}
+		if err == nil && (r.length != test.length || r.offset != test.offset) {
+			t.Errorf("parseResource(%q) = length %d, offset %d, want %d, %d",
+				test.value, r.length, r.offset, test.length, test.offset)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPlaylistTemplate   = "{name}.m3u8"
+	defaultSegmentTemplate    = "{name}-{seq}{ext}"
+	defaultSingleFileTemplate = "{name}{ext}"
+	defaultExtension          = ".ts"
+)
+
+// segmentExtensions are kept if a segment URI uses them.
+var segmentExtensions = []string{
+	".ts", ".m4s", ".mp4", ".m4a", ".m4v", ".cmfv", ".cmfa", ".cmft",
+	".aac", ".ac3", ".ec3", ".mp3", ".vtt", ".webvtt",
+}
+
+// contentTypeExtensions are used if the extension of the URI is unknown.
+var contentTypeExtensions = map[string]string{
+	"video/mp2t":        ".ts",
+	"video/mp4":         ".mp4",
+	"audio/mp4":         ".m4a",
+	"video/iso.segment": ".m4s",
+	"audio/aac":         ".aac",
+	"audio/x-aac":       ".aac",
+	"audio/ac3":         ".ac3",
+	"audio/eac3":        ".ec3",
+	"audio/mpeg":        ".mp3",
+	"text/vtt":          ".vtt",
+}
+
+var (
+	templatePattern      = regexp.MustCompile(`\{([a-z]+)\}`)
+	templatePlaceholders = []string{
+		"name", "index", "bandwidth", "resolution", "group", "language",
+		"seq", "dseq", "pdt", "uri", "ext",
+	}
+	templateReplacer = strings.NewReplacer("/", "_", `\`, "_")
+)
+
+// CheckTemplate verifies that the template only uses known placeholders:
+// {name}, {index}, {bandwidth}, {resolution}, {group} and {language} of the
+// stream and {seq}, {dseq} (discontinuity sequence), {pdt}, {uri}
+// (basename of the original URI) and {ext} (file extension) of the segment.
+func CheckTemplate(template string) error {
+	for _, m := range templatePattern.FindAllStringSubmatch(template, -1) {
+		if !contains(templatePlaceholders, m[1]) {
+			return fmt.Errorf("unknown placeholder in template '%s': %s", template, m[0])
+		}
+	}
+	return nil
+}
+
+// CheckSegmentTemplate verifies the segment template like CheckTemplate.
+// Unless all segments are stored in a single file, it must also contain
+// {seq}. {uri} and {pdt} are not unique: segments often differ only by the
+// query of their URI and {pdt} is empty for segments without a date.
+func CheckSegmentTemplate(template string, singleFile bool) error {
+	if err := CheckTemplate(template); err != nil || template == "" || singleFile {
+		return err
+	}
+	for _, m := range templatePattern.FindAllStringSubmatch(template, -1) {
+		if m[1] == "seq" {
+			return nil
+		}
+	}
+	return fmt.Errorf("segment template '%s' must contain {seq} unless -single-file is used", template)
+}
+
+func (s *stream) placeholder(name string, seg *segment) string {
+	switch name {
+	case "name":
+		return s.name
+	case "index":
+		if s.index > 0 {
+			return strconv.Itoa(s.index)
+		}
+	case "bandwidth":
+		return s.attr["BANDWIDTH"]
+	case "resolution":
+		return s.attr["RESOLUTION"]
+	case "group":
+		for _, k := range []string{"VIDEO", "AUDIO", "SUBTITLES"} {
+			if g := s.attr[k]; g != "" {
+				return g
+			}
+		}
+	case "language":
+		return s.language
+	case "ext":
+		if seg != nil && seg.ext != "" {
+			return seg.ext
+		}
+		if s.output.ext != "" {
+			return s.output.ext
+		}
+		return defaultExtension
+	}
+
+	if seg == nil {
+		return ""
+	}
+	switch name {
+	case "seq":
+		return strconv.Itoa(seg.sequence)
+	case "dseq":
+		return strconv.Itoa(seg.discontinuity)
+	case "pdt":
+		if !seg.pdt.IsZero() {
+			return seg.pdt.UTC().Format("20060102T150405.000Z")
+		}
+	case "uri":
+		if u, err := url.Parse(seg.uri); err == nil {
+			return path.Base(u.Path)
+		}
+		return path.Base(seg.uri)
+	}
+	return ""
+}
+
+// expand replaces the placeholders in the template. Slashes in the values
+// are replaced so they cannot change the directory layout.
+func (s *stream) expand(template string, seg *segment) string {
+	return templatePattern.ReplaceAllStringFunc(template, func(m string) string {
+		return templateReplacer.Replace(s.placeholder(m[1:len(m)-1], seg))
+	})
+}
+
+// segmentExtension returns the file extension for a segment, taken from the
+// URI if it is known and from the Content-Type of the response otherwise.
+func (d *Dumper) segmentExtension(u *url.URL, resp *http.Response) string {
+	if d.Extension != "" {
+		if !strings.HasPrefix(d.Extension, ".") {
+			return "." + d.Extension
+		}
+		return d.Extension
+	}
+
+	if ext := strings.ToLower(path.Ext(u.Path)); contains(segmentExtensions, ext) {
+		return ext
+	}
+	if t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		if ext, ok := contentTypeExtensions[t]; ok {
+			return ext
+		}
+	}
+	return defaultExtension
+}
+
+func (d *Dumper) playlistTemplate() string {
+	if d.PlaylistTemplate != "" {
+		return d.PlaylistTemplate
+	}
+	return defaultPlaylistTemplate
+}
+
+func (d *Dumper) segmentTemplate() string {
+	if d.SegmentTemplate != "" {
+		return d.SegmentTemplate
+	}
+	if d.SingleFile {
+		return defaultSingleFileTemplate
+	}
+	return defaultSegmentTemplate
+}
+
+// playlistName returns the name of the output playlist of the stream.
+func (s *stream) playlistName() string {
+	if s.d.Mirror {
+		return s.d.mirrorPath(s.playlistURL(), s.query)
+	}
+	return s.expand(s.d.playlistTemplate(), nil)
+}
+
+// segmentName returns the name of the segment file. seg is nil for the
+// single output file.
+func (s *stream) segmentName(seg *segment) string {
+	if s.d.Mirror && seg != nil {
+		if u, err := s.resolve(seg.uri); err == nil {
+			return s.d.mirrorPath(u, s.query)
+		}
+	}
+	return s.expand(s.d.segmentTemplate(), seg)
+}
+
+// relativeName returns the reference to the file name from the file from.
+func relativeName(from, name string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(name))
+	if err != nil {
+		return name
+	}
+	return filepath.ToSlash(rel)
+}
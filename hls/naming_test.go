@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSegmentTemplate(t *testing.T) {
+	tests := []struct {
+		template   string
+		singleFile bool
+		err        bool
+	}{
+		{"", false, false},
+		{"", true, false},
+		{"{name}-{seq}{ext}", false, false},
+		{"{name}/{dseq}-{seq}{ext}", false, false},
+		{"{group}/{seq}-{uri}", false, false},
+		{"{group}/{uri}", false, true},
+		{"{name}-{pdt}{ext}", false, true},
+		{"{name}{ext}", false, true},
+		{"{name}-{dseq}{ext}", false, true},
+		{"segment.ts", false, true},
+		{"{name}{ext}", true, false},
+		{"{name}-{foo}{ext}", true, true},
+		{"{name}-{seq}-{foo}{ext}", false, true},
+	}
+
+	for _, test := range tests {
+		err := CheckSegmentTemplate(test.template, test.singleFile)
+		if (err != nil) != test.err {
+			t.Errorf("CheckSegmentTemplate(%q, %v) = %v", test.template, test.singleFile, err)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	s := &stream{
+		name:     "video",
+		index:    2,
+		attr:     map[string]string{"BANDWIDTH": "800000", "AUDIO": "aac"},
+		language: "en",
+	}
+	seg := &segment{
+		uri:           "https://example.com/a/b/seg-7.ts?token=x",
+		sequence:      7,
+		discontinuity: 1,
+		ext:           ".m4s",
+		pdt:           time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC),
+	}
+
+	tests := []struct {
+		template string
+		seg      *segment
+		want     string
+	}{
+		{"{name}.m3u8", nil, "video.m3u8"},
+		{"{name}-{index}-{bandwidth}-{group}-{language}.m3u8", nil, "video-2-800000-aac-en.m3u8"},
+		{"{name}{ext}", nil, "video.ts"},
+		{"{name}/{dseq}-{seq}{ext}", seg, "video/1-7.m4s"},
+		{"{uri}", seg, "seg-7.ts"},
+		{"{pdt}{ext}", seg, "20200102T030405.006Z.m4s"},
+		{"{seq}", nil, ""},
+	}
+
+	for _, test := range tests {
+		if got := s.expand(test.template, test.seg); got != test.want {
+			t.Errorf("expand(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
@@ -4,12 +4,15 @@ package hls
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -35,15 +38,29 @@ var segmentTags = map[string]struct{}{
 }
 
 type playlist struct {
-	client         http.Client
-	url            *url.URL
-	file           *os.File
+	client     http.Client
+	url        *url.URL
+	base       *url.URL
+	validators struct {
+		url          string
+		etag         string
+		lastModified string
+	}
+	name           string
+	file           File
 	writer         *bufio.Writer
 	version        int
 	sequence       int
+	discontinuity  int
 	targetDuration time.Duration
-	lastDuration   time.Duration
+	hash           [sha1.Size]byte
+	changed        bool
+	stall          stallState
+	snapshots      snapshots
+	retries        int
 	active         bool
+	vod            bool
+	segments       int // Number of segments in the last loaded playlist
 	err            error
 }
 
@@ -54,6 +71,17 @@ type segment struct {
 	length   int64
 	offset   int64
 	comments string
+	added    time.Time
+	marker   string
+	retries  int
+
+	discontinuity int
+	pdt           time.Time
+	resources     []*resource
+	ext           string
+
+	written   int64
+	validator string
 }
 
 var (
@@ -61,6 +89,47 @@ var (
 	errOffsetFirstSegment    = errors.New("offset must be in first segment")
 )
 
+func (s *stream) playlistURL() *url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.playlist.url
+}
+
+// setBaseURL sets the URL that relative URIs are resolved against after the
+// playlist was redirected to it. req is updated if redirects are reused.
+func (s *stream) setBaseURL(req *http.Request, redirected *url.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if redirected == nil || redirected.String() == s.playlist.url.String() {
+		s.playlist.base = nil
+		return
+	}
+
+	if s.playlist.base == nil || s.playlist.base.String() != redirected.String() {
+		log.Println("Playlist", s.name, "redirected to", redirected)
+	}
+	s.playlist.base = redirected
+	if s.d.Redirect.Reuse {
+		s.playlist.url = redirected
+		s.playlist.base = nil
+		req.URL = redirected
+		req.Host = redirected.Host
+	}
+}
+
+// resolve resolves a URI from the media playlist to a request URL.
+func (s *stream) resolve(ref string) (*url.URL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	base := s.playlist.base
+	if base == nil {
+		base = s.playlist.url
+	}
+	return s.d.resolveURL(base, ref, s.query)
+}
+
 func (s *stream) parseHeader(scanner *bufio.Scanner) (err error) {
 	if !scanner.Scan() {
 		err = eofIfNil(scanner.Err())
@@ -85,7 +154,8 @@ func (s *stream) parseHeader(scanner *bufio.Scanner) (err error) {
 
 	version := 1
 	sequence := 0
-	var targetDuration time.Duration
+	discontinuity := 0 // Also if the tag is missing in a reload
+	var targetDuration, holdBack time.Duration
 
 loop:
 	for scanner.Scan() {
@@ -112,9 +182,23 @@ loop:
 				targetDuration = time.Duration(duration) * time.Second
 			case "EXT-X-MEDIA-SEQUENCE":
 				sequence, err = strconv.Atoi(v)
+			case "EXT-X-DISCONTINUITY-SEQUENCE":
+				discontinuity, err = strconv.Atoi(v)
+			case "EXT-X-SERVER-CONTROL":
+				attr := parseAttributeList(v)
+				if attr == nil {
+					err = errInvalidAttributeList
+					break
+				}
+				if hb, ok := attr["HOLD-BACK"]; ok {
+					holdBack, err = parseDuration(hb)
+				}
 			case "EXT-X-PLAYLIST-TYPE":
-				if !initial && v == "VOD" {
-					s.playlist.active = false
+				if v == "VOD" {
+					s.playlist.vod = true
+					if !initial {
+						s.playlist.active = false
+					}
 				}
 			default:
 				if _, ok := segmentTags[k]; ok {
@@ -160,6 +244,12 @@ loop:
 		}
 	}
 
+	s.playlist.discontinuity = discontinuity
+
+	if holdBack > 0 && holdBack < 3*s.playlist.targetDuration {
+		log.Println("Warning: HOLD-BACK", holdBack, "is less than three target durations")
+	}
+
 	if sequence > s.playlist.sequence {
 		s.playlist.sequence = sequence
 	} else if sequence != s.playlist.sequence {
@@ -169,12 +259,15 @@ loop:
 	return
 }
 
-func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
+func (s *stream) parseSegments(scanner *bufio.Scanner) (newSegments int, pdt time.Time, err error) {
 	sequence := s.playlist.sequence
-	newSegments := 0
+	discontinuity := s.playlist.discontinuity
 
 	var length, offset int64 = -1, -1
 	var duration int
+	var exactDuration float64
+	var segmentPDT time.Time
+	var resources []*resource
 	var title string
 	var comments strings.Builder
 
@@ -190,6 +283,7 @@ func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
 				switch k {
 				case "EXTINF":
 					v, title = splitPair(v, ',')
+					exactDuration, _ = strconv.ParseFloat(v, 64)
 					v, _ = splitPair(v, '.')
 					duration, err = strconv.Atoi(v)
 				case "EXT-X-BYTERANGE":
@@ -213,8 +307,26 @@ func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
 					line = "" // Do not write to output playlist
 				case "EXT-X-GAP":
 					length = 0
+				case "EXT-X-KEY", "EXT-X-MAP":
+					if s.d.Mirror {
+						var r *resource
+						if r, err = parseResource(k, v); r != nil {
+							resources = append(resources, r)
+						}
+						line = s.d.mirrorLine(s.baseURL(), s.query, s.playlist.name, line)
+					}
+				case "EXT-X-DISCONTINUITY":
+					discontinuity++
+				case "EXT-X-PROGRAM-DATE-TIME":
+					if t, perr := time.Parse(time.RFC3339Nano, v); perr == nil {
+						segmentPDT = t
+						if t.After(pdt) {
+							pdt = t
+						}
+					}
 				case "EXT-X-ENDLIST":
 					s.playlist.active = false
+					s.playlist.vod = true
 				}
 
 				if err != nil {
@@ -240,21 +352,28 @@ func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
 				duration: duration,
 				uri:      line,
 				comments: comments.String(),
+				added:    time.Now(),
 				length:   length,
 				offset:   offset,
+
+				discontinuity: discontinuity,
+				pdt:           segmentPDT,
+				resources:     resources,
 			}
 
 			s.output.queue.sequence = sequence
-			if duration > 0 {
-				s.playlist.lastDuration = time.Duration(duration) * time.Second
-			}
 		}
 
 		if length > 0 {
 			offset += length
 		}
+		if !segmentPDT.IsZero() {
+			segmentPDT = segmentPDT.Add(time.Duration(exactDuration * float64(time.Second)))
+		}
 		length = -1
 		duration = 0
+		exactDuration = 0
+		resources = nil
 		title = ""
 		comments.Reset()
 		sequence++
@@ -264,6 +383,8 @@ func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
 		return
 	}
 
+	s.playlist.segments = sequence - s.playlist.sequence
+
 	if s.d.Verbose {
 		log.Println("Found", newSegments, "new segments")
 	}
@@ -271,48 +392,140 @@ func (s *stream) parseSegments(scanner *bufio.Scanner) (err error) {
 	return
 }
 
+// setConditionalHeaders adds the validators of the previous response
+// if the playlist is reloaded from the same URL.
+func (s *stream) setConditionalHeaders(req *http.Request) bool {
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	v := &s.playlist.validators
+	if v.url != req.URL.String() {
+		return false
+	}
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+	return v.etag != "" || v.lastModified != ""
+}
+
 func (s *stream) fetchPlaylist(req *http.Request) (err error) {
-	s.playlist.lastDuration = s.playlist.targetDuration / 2
+	s.playlist.changed = false
 
-	resp, err := s.playlist.client.Do(req)
+	conditional := s.setConditionalHeaders(req)
+	requestTime := time.Now()
+	rec := s.newRecord(RequestMedia, nil)
+	rec.Retry = s.playlist.retries
+	resp, err := s.d.do(&s.playlist.client, req, rec)
 	if err != nil {
+		if s.d.Snapshots {
+			s.snapshot(req, requestTime, nil, nil, err)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
+	var body io.Reader = resp.Body
+	if s.d.Snapshots {
+		var b []byte
+		b, err = ioutil.ReadAll(resp.Body)
+		s.snapshot(req, requestTime, resp, b, err)
+		if err != nil {
+			return
+		}
+		body = bytes.NewReader(b)
+	}
+
+	s.setBaseURL(req, redirectedURL(resp))
+
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		// Unchanged, try again after half the target duration
+		if s.d.Verbose {
+			log.Println("Playlist not modified")
+		}
+		err = s.checkStall(false, 0, time.Time{})
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
 		err = httpResponseStatusError(resp)
 		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
+	if !s.d.DisableConditionalReload {
+		s.playlist.validators.url = req.URL.String()
+		s.playlist.validators.etag = resp.Header.Get("ETag")
+		s.playlist.validators.lastModified = resp.Header.Get("Last-Modified")
+	}
+
+	hash := sha1.New()
+	scanner := bufio.NewScanner(io.TeeReader(body, hash))
 
+	sequence := s.playlist.sequence
 	if err = s.parseHeader(scanner); err != nil {
 		log.Println("Failed to read playlist header:", err)
 		return
 	}
 
-	if err = s.parseSegments(scanner); err != nil {
+	newSegments, pdt, err := s.parseSegments(scanner)
+	if err != nil {
 		log.Println("Failed to read playlist segments:", err)
 		return
 	}
 
+	var sum [sha1.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	s.playlist.changed = sum != s.playlist.hash
+	s.playlist.hash = sum
+
+	err = s.checkStall(sequence != s.playlist.sequence, newSegments, pdt)
+
 	return
 }
 
-func (s *stream) playlistLoop() (err error) {
-	s.playlist.client.Timeout = 5 * time.Second
-	if s.d.PlaylistTimeout >= 0 {
-		s.playlist.client.Timeout = s.d.PlaylistTimeout
+// reloadDelay returns the time to wait before reloading the playlist,
+// measured from the start of the last reload (RFC 8216, section 6.3.4).
+func (p *playlist) reloadDelay() time.Duration {
+	d := p.targetDuration
+	if !p.changed {
+		d /= 2
+	}
+	return d
+}
+
+func (s *stream) recordReload(t time.Time, actual, scheduled time.Duration) {
+	changed := s.playlist.changed
+	s.d.record(&metadataRecord{
+		Time:      t,
+		Stream:    s.name,
+		Type:      recordReload,
+		Scheduled: scheduled.Seconds(),
+		Actual:    actual.Seconds(),
+		Changed:   &changed,
+	})
+}
+
+func (d *Dumper) playlistTimeout() time.Duration {
+	if d.PlaylistTimeout >= 0 {
+		return d.PlaylistTimeout
 	}
+	return 5 * time.Second
+}
 
-	req, err := s.d.newRequest(s.playlist.url.String())
+func (s *stream) playlistLoop() (err error) {
+	s.playlist.client = s.d.newClient(s.d.playlistTimeout())
+
+	req, err := s.d.newRequest(s.playlistURL().String())
 	if err != nil {
 		log.Println("Failed to create playlist request:", err)
 		return
 	}
 
-	var sleep time.Duration
+	var sleep, delay time.Duration
+	var last time.Time
+	var failures int
+	var failedSince time.Time
 	for s.playlist.active {
 		time.Sleep(sleep)
 		if !s.playlist.active {
@@ -320,13 +533,50 @@ func (s *stream) playlistLoop() (err error) {
 		}
 
 		before := time.Now()
-		if err = s.fetchPlaylist(req); err != nil {
-			log.Println("Failed to fetch playlist:", err)
-			if _, ok := err.(fatalError); ok || s.playlist.lastDuration == 0 {
-				return
+		s.playlist.retries = failures
+		err = s.fetchPlaylist(req)
+		if !last.IsZero() {
+			s.recordReload(before, before.Sub(last), delay)
+		}
+		last = before
+		delay = s.playlist.reloadDelay()
+		sleep = time.Until(before) + delay
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		if err == ErrStalled {
+			return
+		}
+		log.Println("Failed to fetch playlist:", err)
+		if failures == 0 {
+			failedSince = before
+		}
+		failures++
+
+		if s.d.Resign && failures == 1 && isAuthError(err) {
+			rerr := s.resign(req.URL)
+			if rerr == nil {
+				req.URL = s.playlistURL()
+				req.Host = req.URL.Host
+				sleep = 0
+				continue
 			}
+			log.Println("Failed to re-sign stream:", rerr)
+		}
+
+		if s.playlist.targetDuration == 0 {
+			return
+		}
+		if err = s.d.Retry.check(err, failures, failedSince); err != nil {
+			return
+		}
+
+		if backoff := s.d.Retry.backoff(failures); backoff > delay {
+			delay = backoff
+			sleep = time.Until(before) + delay
 		}
-		sleep = time.Until(before) + s.playlist.lastDuration
 	}
 
 	return
@@ -334,6 +584,7 @@ func (s *stream) playlistLoop() (err error) {
 
 func (s *stream) playlistWorker() {
 	defer close(s.output.queue.c)
+	defer s.closeSnapshots()
 	s.playlist.err = s.playlistLoop()
 	s.playlist.active = false
 }
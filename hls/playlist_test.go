@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaderDiscontinuity(t *testing.T) {
+	s := &stream{d: &Dumper{}}
+	s.playlist.writer = bufio.NewWriter(ioutil.Discard) // Not the initial load
+
+	reloads := []struct {
+		playlist      string
+		discontinuity int
+	}{
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-DISCONTINUITY-SEQUENCE:3\n#EXTINF:2,\na.ts\n", 3},
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.ts\n", 0},
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-DISCONTINUITY-SEQUENCE:4\n#EXTINF:2,\na.ts\n", 4},
+	}
+
+	for i, reload := range reloads {
+		scanner := bufio.NewScanner(strings.NewReader(reload.playlist))
+		if err := s.parseHeader(scanner); err != nil {
+			t.Fatal(i, err)
+		}
+		if s.playlist.discontinuity != reload.discontinuity {
+			t.Errorf("reload %d: discontinuity sequence = %d, want %d", i, s.playlist.discontinuity, reload.discontinuity)
+		}
+	}
+}
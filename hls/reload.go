@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renditionAttributes describe an EXT-X-MEDIA rendition in the log.
+var renditionAttributes = []string{"TYPE", "GROUP-ID", "NAME", "LANGUAGE", "CHANNELS"}
+
+var errMasterChanged = errors.New("master playlist was replaced by a media playlist")
+
+func joinAttributes(attr map[string]string, keys []string) string {
+	var b strings.Builder
+	for _, k := range keys {
+		if v, ok := attr[k]; ok {
+			if b.Len() > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k + "=" + v)
+		}
+	}
+	return b.String()
+}
+
+// variantKeys identify variants across master playlist reloads. The URIs
+// are not used since they usually change when they are re-signed.
+func variantKeys(variants []*variant) []string {
+	keys := make([]string, len(variants))
+	seen := make(map[string]int, len(variants))
+	for i, v := range variants {
+		k := joinAttributes(v.attr, variantAttributes)
+		if seen[k]++; seen[k] > 1 {
+			k = fmt.Sprintf("%s (%d)", k, seen[k])
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
+// parseRenditions returns a description of each EXT-X-MEDIA tag.
+func parseRenditions(b []byte) (renditions []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, tagPrefix) {
+			continue
+		}
+
+		k, v := splitPair(line[1:], tagSeparator)
+		if k == "EXT-X-MEDIA" {
+			renditions = append(renditions, joinAttributes(parseAttributeList(v), renditionAttributes))
+		}
+	}
+	return
+}
+
+// audioLanguages returns the language of the default (or first)
+// audio rendition for each group ID.
+func audioLanguages(b []byte) map[string]string {
+	languages := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, tagPrefix) {
+			continue
+		}
+
+		k, v := splitPair(line[1:], tagSeparator)
+		if k != "EXT-X-MEDIA" {
+			continue
+		}
+		attr := parseAttributeList(v)
+		if attr["TYPE"] != "AUDIO" || attr["LANGUAGE"] == "" {
+			continue
+		}
+		if _, ok := languages[attr["GROUP-ID"]]; !ok || attr["DEFAULT"] == "YES" {
+			languages[attr["GROUP-ID"]] = attr["LANGUAGE"]
+		}
+	}
+	return languages
+}
+
+func diffKeys(old, new []string) (added, removed []string) {
+	for _, k := range new {
+		if !contains(old, k) {
+			added = append(added, k)
+		}
+	}
+	for _, k := range old {
+		if !contains(new, k) {
+			removed = append(removed, k)
+		}
+	}
+	return
+}
+
+// reloadMaster fetches the master playlist again, starts streams for new
+// variants and ends the streams of variants that have disappeared.
+func (d *Dumper) reloadMaster(wg *sync.WaitGroup, erro *error) (err error) {
+	masterURL, query, b, err := d.fetchMaster(d.URL)
+	if err != nil {
+		return
+	}
+
+	variants, media, err := d.parseMaster(masterURL, query, bufio.NewScanner(bytes.NewReader(b)))
+	if err != nil {
+		return
+	}
+	if media {
+		return errMasterChanged
+	}
+
+	keys := variantKeys(variants)
+	renditions := parseRenditions(b)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	added, removed := diffKeys(d.renditions, renditions)
+	for _, r := range removed {
+		log.Println("Rendition removed from master playlist:", r)
+	}
+	for _, r := range added {
+		log.Println("Rendition added to master playlist:", r)
+	}
+	d.renditions = renditions
+	d.languages = audioLanguages(b)
+
+	if d.stop {
+		return
+	}
+
+	var active []string
+	running := false
+	for _, s := range d.streams {
+		running = running || !s.ended
+		if s.removed {
+			continue
+		}
+		if !contains(keys, s.key) {
+			log.Println("Variant removed from master playlist:", s.key)
+			s.removed = true
+			s.playlist.active = false
+			continue
+		}
+		active = append(active, s.key)
+	}
+	if !running {
+		// All streams have finished, the dump is about to end
+		return
+	}
+
+	for i, v := range variants {
+		if contains(active, keys[i]) {
+			continue
+		}
+
+		s := d.newStream(v, keys[i], query)
+		log.Println("Variant added to master playlist:", s.key)
+		log.Println("Downloading stream:", s.playlist.url)
+		d.streams = append(d.streams, s)
+
+		wg.Add(1)
+		go s.start(wg, erro)
+	}
+	return
+}
+
+// masterLoop reloads the master playlist until done is closed.
+func (d *Dumper) masterLoop(wg *sync.WaitGroup, erro *error, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(d.MasterReload):
+		}
+
+		if d.stop {
+			return
+		}
+		if err := d.reloadMaster(wg, erro); err != nil {
+			log.Println("Failed to reload master playlist:", err)
+		}
+	}
+}
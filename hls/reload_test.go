@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVariantKeys(t *testing.T) {
+	variants := []*variant{
+		{attr: map[string]string{"BANDWIDTH": "1280000", "RESOLUTION": "640x360", "AUDIO": "aac"}},
+		{attr: map[string]string{"BANDWIDTH": "2560000", "RESOLUTION": "1280x720", "NAME": "ignored"}},
+		{attr: map[string]string{"BANDWIDTH": "1280000", "RESOLUTION": "640x360", "AUDIO": "aac"}},
+		{attr: map[string]string{}},
+	}
+	want := []string{
+		"BANDWIDTH=1280000,RESOLUTION=640x360,AUDIO=aac",
+		"BANDWIDTH=2560000,RESOLUTION=1280x720",
+		"BANDWIDTH=1280000,RESOLUTION=640x360,AUDIO=aac (2)",
+		"",
+	}
+
+	if keys := variantKeys(variants); !reflect.DeepEqual(keys, want) {
+		t.Errorf("variantKeys() = %q, want %q", keys, want)
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	added, removed := diffKeys([]string{"a", "b", "c"}, []string{"b", "c", "d"})
+	if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"a"}) {
+		t.Errorf("diffKeys() = %q, %q", added, removed)
+	}
+}
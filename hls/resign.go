@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// variantAttributes are compared to find the same variant in a re-fetched
+// master playlist, since the URIs usually change when they are re-signed.
+var variantAttributes = []string{
+	"BANDWIDTH", "RESOLUTION", "CODECS", "FRAME-RATE",
+	"VIDEO", "AUDIO", "SUBTITLES", "CLOSED-CAPTIONS",
+}
+
+var (
+	errVariantNotFound   = errors.New("no matching variant in master playlist")
+	errEmptyResignOutput = errors.New("re-sign command did not print a URL")
+)
+
+func isAuthError(err error) bool {
+	serr, ok := err.(statusError)
+	return ok && (serr.code == http.StatusUnauthorized || serr.code == http.StatusForbidden)
+}
+
+// freshMasterURL runs the re-sign command (if any) to obtain a new master
+// playlist URL. The command gets the original URL in HLSDUMP_URL.
+func (d *Dumper) freshMasterURL() (string, error) {
+	args := strings.Fields(d.ResignCommand)
+	if len(args) == 0 {
+		return d.URL, nil
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "HLSDUMP_URL="+d.URL)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("re-sign command failed: %s", err)
+	}
+
+	u, _ := splitPair(strings.TrimSpace(string(out)), '\n')
+	if u = strings.TrimSpace(u); u == "" {
+		return "", errEmptyResignOutput
+	}
+	return u, nil
+}
+
+// matchVariant returns the variant with the key of the stream. Duplicate
+// variants (e.g. backups) are told apart by their order, see variantKeys.
+func matchVariant(variants []*variant, key string) *variant {
+	for i, k := range variantKeys(variants) {
+		if k == key {
+			return variants[i]
+		}
+	}
+	return nil
+}
+
+// resign fetches the master playlist again and switches the stream to the
+// URL of the same variant. failed is the playlist URL that was rejected,
+// nothing is done if the stream was already switched to another URL.
+func (s *stream) resign(failed *url.URL) (err error) {
+	s.d.resignMu.Lock()
+	defer s.d.resignMu.Unlock()
+
+	if s.playlistURL().String() != failed.String() {
+		return
+	}
+
+	u, err := s.d.freshMasterURL()
+	if err != nil {
+		return
+	}
+
+	masterURL, query, b, err := s.d.fetchMaster(u)
+	if err != nil {
+		return
+	}
+
+	variants, media, err := s.d.parseMaster(masterURL, query, bufio.NewScanner(bytes.NewReader(b)))
+	if err != nil {
+		return
+	}
+
+	playlistURL := masterURL
+	if !media {
+		v := matchVariant(variants, s.key)
+		if v == nil {
+			err = errVariantNotFound
+			return
+		}
+		playlistURL = v.url
+	}
+
+	log.Println("Re-signed stream", s.name+":", playlistURL)
+	s.mu.Lock()
+	s.playlist.url = playlistURL
+	s.playlist.base = nil
+	s.query = query
+	s.mu.Unlock()
+	return
+}
+
+// resignSegment re-signs the stream and looks up the new URI of the segment
+// in the media playlist.
+func (s *stream) resignSegment(seg *segment, failed *url.URL) (err error) {
+	if err = s.resign(failed); err != nil {
+		return
+	}
+
+	req, err := s.d.newRequest(s.playlistURL().String())
+	if err != nil {
+		return
+	}
+
+	client := s.d.newClient(s.d.playlistTimeout())
+	resp, err := s.d.do(&client, req, s.newRecord(RequestMedia, seg))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = httpResponseStatusError(resp)
+		return
+	}
+
+	sequence := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '#' {
+			if k, v := splitPair(line[1:], tagSeparator); k == "EXT-X-MEDIA-SEQUENCE" {
+				if sequence, err = strconv.Atoi(v); err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		if sequence == seg.sequence {
+			seg.uri = line
+			return
+		}
+		sequence++
+	}
+
+	if err = scanner.Err(); err == nil {
+		err = fmt.Errorf("segment %d is no longer in the playlist", seg.sequence)
+	}
+	return
+}
@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMatchVariant(t *testing.T) {
+	newVariant := func(rawurl, bandwidth string) *variant {
+		u, _ := url.Parse(rawurl)
+		return &variant{url: u, attr: map[string]string{"BANDWIDTH": bandwidth, "CODECS": "avc1"}}
+	}
+	old := []*variant{
+		newVariant("http://a.test/1.m3u8?sig=old", "1000"),
+		newVariant("http://b.test/1.m3u8?sig=old", "1000"), // Backup
+		newVariant("http://a.test/2.m3u8?sig=old", "2000"),
+	}
+	fresh := []*variant{
+		newVariant("http://a.test/1.m3u8?sig=new", "1000"),
+		newVariant("http://b.test/1.m3u8?sig=new", "1000"),
+		newVariant("http://a.test/2.m3u8?sig=new", "2000"),
+	}
+
+	for i, key := range variantKeys(old) {
+		v := matchVariant(fresh, key)
+		if v != fresh[i] {
+			t.Errorf("variant %d (%s) matched %v", i, key, v)
+		}
+	}
+	if v := matchVariant(fresh[:1], variantKeys(old)[1]); v != nil {
+		t.Errorf("removed backup variant matched %s", v.url)
+	}
+}
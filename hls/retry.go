@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBackoff    = 128 * time.Millisecond
+	defaultMaxBackoff = 1024 * time.Millisecond
+)
+
+// Error kinds that can be used in RetryPolicy.Errors.
+const (
+	ErrorTimeout    = "timeout"
+	ErrorNetwork    = "network"
+	ErrorIncomplete = "incomplete"
+	ErrorStatus     = "status"
+	ErrorOther      = "other"
+)
+
+// RetryPolicy controls how failed segment downloads and playlist reloads
+// are retried. The zero value retries forever with the default backoff.
+type RetryPolicy struct {
+	// MaxAttempts limits the number of attempts (0 = unlimited).
+	MaxAttempts int
+	// MaxElapsed limits the time spent on a segment, measured from the time
+	// it first appeared in the playlist (0 = unlimited). For playlist reloads
+	// it is measured from the first failed reload.
+	MaxElapsed time.Duration
+
+	// Backoff is the delay after the first failure, doubled for each attempt
+	// up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to the given fraction (e.g. 0.2).
+	Jitter float64
+
+	// Status overrides the number of retries for HTTP status codes before the
+	// error becomes fatal (negative = unlimited). By default, client errors
+	// (4xx) except 429 are fatal immediately.
+	Status map[int]int
+	// Errors overrides the number of retries for the error kinds above.
+	Errors map[string]int
+}
+
+type statusError struct {
+	error
+	code int
+}
+
+type incompleteError struct {
+	error
+}
+
+func errorKind(err error) string {
+	switch err := err.(type) {
+	case statusError:
+		return ErrorStatus
+	case incompleteError:
+		return ErrorIncomplete
+	case net.Error:
+		if err.Timeout() {
+			return ErrorTimeout
+		}
+		return ErrorNetwork
+	}
+	if err == io.ErrUnexpectedEOF {
+		return ErrorNetwork
+	}
+	return ErrorOther
+}
+
+// retries returns the number of retries allowed for an error before it
+// becomes fatal, or a negative value if the error class is not limited.
+func (p *RetryPolicy) retries(err error) int {
+	if serr, ok := err.(statusError); ok {
+		if n, ok := p.Status[serr.code]; ok {
+			return n
+		}
+		if serr.code >= http.StatusBadRequest && serr.code < http.StatusInternalServerError &&
+			serr.code != http.StatusTooManyRequests {
+			return 0
+		}
+	}
+	if n, ok := p.Errors[errorKind(err)]; ok {
+		return n
+	}
+	return -1
+}
+
+// check returns a non-nil error if no further attempt should be made after
+// try failed attempts. Errors that exhausted their class limit become fatal.
+func (p *RetryPolicy) check(err error, try int, since time.Time) error {
+	if _, ok := err.(fatalError); ok {
+		return err
+	}
+	if n := p.retries(err); n >= 0 && try > n {
+		return fatal(err)
+	}
+	if p.MaxAttempts > 0 && try >= p.MaxAttempts {
+		return fmt.Errorf("attempt limit reached (%d): %s", try, err)
+	}
+	if p.MaxElapsed > 0 && time.Since(since) >= p.MaxElapsed {
+		return fmt.Errorf("time limit reached (%s): %s", time.Since(since).Round(time.Millisecond), err)
+	}
+	return nil
+}
+
+func (p *RetryPolicy) backoff(try int) time.Duration {
+	d, max := p.Backoff, p.MaxBackoff
+	if d <= 0 {
+		d = defaultBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	// Compare before shifting, the result might overflow
+	if shift := min(uint(try-1), 32); d > max>>shift {
+		d = max
+	} else {
+		d <<= shift
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// ParseRetryOverrides parses a list of kind=retries pairs.
+func ParseRetryOverrides(values []string) (map[string]int, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]int, len(values))
+	for _, value := range values {
+		k, v := splitPair(value, '=')
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry override '%s': %s", value, err)
+		}
+		m[strings.TrimSpace(k)] = n
+	}
+	return m, nil
+}
+
+// ParseRetryStatus parses a list of status=retries pairs.
+func ParseRetryStatus(values []string) (map[int]int, error) {
+	overrides, err := ParseRetryOverrides(values)
+	if err != nil || overrides == nil {
+		return nil, err
+	}
+
+	m := make(map[int]int, len(overrides))
+	for k, n := range overrides {
+		code, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP status code '%s'", k)
+		}
+		m[code] = n
+	}
+	return m, nil
+}
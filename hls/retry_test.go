@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyCheck(t *testing.T) {
+	const (
+		retry = iota
+		fatalErr
+		limit
+	)
+
+	status := func(code int) error {
+		return statusError{errors.New(http.StatusText(code)), code}
+	}
+	timeout := &net.DNSError{Err: "timeout", IsTimeout: true}
+	network := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	incomplete := incompleteError{io.ErrUnexpectedEOF}
+
+	tests := []struct {
+		policy  RetryPolicy
+		err     error
+		try     int
+		elapsed time.Duration
+		want    int
+	}{
+		// Unlimited by default, except for client errors
+		{RetryPolicy{}, status(500), 100, time.Hour, retry},
+		{RetryPolicy{}, timeout, 100, time.Hour, retry},
+		{RetryPolicy{}, status(404), 1, 0, fatalErr},
+		{RetryPolicy{}, status(403), 1, 0, fatalErr},
+		{RetryPolicy{}, status(429), 100, 0, retry},
+		{RetryPolicy{}, fatal(network), 1, 0, fatalErr},
+
+		// Attempt and time limits
+		{RetryPolicy{MaxAttempts: 3}, status(503), 2, 0, retry},
+		{RetryPolicy{MaxAttempts: 3}, status(503), 3, 0, limit},
+		{RetryPolicy{MaxElapsed: time.Minute}, network, 1, 30 * time.Second, retry},
+		{RetryPolicy{MaxElapsed: time.Minute}, network, 1, 2 * time.Minute, limit},
+
+		// Per-status overrides
+		{RetryPolicy{Status: map[int]int{404: 2}}, status(404), 2, 0, retry},
+		{RetryPolicy{Status: map[int]int{404: 2}}, status(404), 3, 0, fatalErr},
+		{RetryPolicy{Status: map[int]int{403: -1}}, status(403), 100, 0, retry},
+		{RetryPolicy{Status: map[int]int{503: 0}}, status(503), 1, 0, fatalErr},
+		{RetryPolicy{Status: map[int]int{503: 5}, MaxAttempts: 3}, status(503), 3, 0, limit},
+
+		// Per-kind overrides
+		{RetryPolicy{Errors: map[string]int{ErrorStatus: 1}}, status(500), 1, 0, retry},
+		{RetryPolicy{Errors: map[string]int{ErrorStatus: 1}}, status(500), 2, 0, fatalErr},
+		{RetryPolicy{Errors: map[string]int{ErrorStatus: 5}}, status(404), 1, 0, fatalErr},
+		{RetryPolicy{Errors: map[string]int{ErrorTimeout: 0}}, timeout, 1, 0, fatalErr},
+		{RetryPolicy{Errors: map[string]int{ErrorTimeout: 0}}, network, 1, 0, retry},
+		{RetryPolicy{Errors: map[string]int{ErrorNetwork: 0}}, io.ErrUnexpectedEOF, 1, 0, fatalErr},
+		{RetryPolicy{Errors: map[string]int{ErrorIncomplete: 1}}, incomplete, 2, 0, fatalErr},
+		{RetryPolicy{Errors: map[string]int{ErrorOther: 0}}, errors.New("other"), 1, 0, fatalErr},
+	}
+
+	for _, test := range tests {
+		err := test.policy.check(test.err, test.try, time.Now().Add(-test.elapsed))
+		got := retry
+		if _, ok := err.(fatalError); ok {
+			got = fatalErr
+		} else if err != nil {
+			got = limit
+		}
+		if got != test.want {
+			t.Errorf("%+v: check(%v, %d, %s) = %v", test.policy, test.err, test.try, test.elapsed, err)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		try    int
+		want   time.Duration
+	}{
+		{RetryPolicy{}, 1, defaultBackoff},
+		{RetryPolicy{}, 2, 2 * defaultBackoff},
+		{RetryPolicy{}, 4, defaultMaxBackoff},
+		{RetryPolicy{}, 10, defaultMaxBackoff},
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, 3, 4 * time.Second},
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, 7, time.Minute},
+
+		// Overflow of the shift is clamped to the maximum
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, 40, time.Minute},
+		{RetryPolicy{Backoff: time.Hour, MaxBackoff: math.MaxInt64}, 25, math.MaxInt64},
+		{RetryPolicy{Backoff: time.Hour, MaxBackoff: math.MaxInt64}, 33, math.MaxInt64},
+		{RetryPolicy{Backoff: time.Hour, MaxBackoff: math.MaxInt64}, 20, time.Hour << 19},
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, math.MaxInt32, time.Minute},
+	}
+
+	for _, test := range tests {
+		if d := test.policy.backoff(test.try); d != test.want {
+			t.Errorf("%+v: backoff(%d) = %s, want %s", test.policy, test.try, d, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 4 * time.Second, Jitter: 0.25}
+	tests := []struct {
+		try      int
+		min, max time.Duration
+	}{
+		{1, 750 * time.Millisecond, 1250 * time.Millisecond},
+		{2, 1500 * time.Millisecond, 2500 * time.Millisecond},
+		{10, 3 * time.Second, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		var varied bool
+		first := p.backoff(test.try)
+		for i := 0; i < 1000; i++ {
+			d := p.backoff(test.try)
+			if d < test.min || d > test.max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", test.try, d, test.min, test.max)
+			}
+			varied = varied || d != first
+		}
+		if !varied {
+			t.Errorf("backoff(%d) is not randomized", test.try)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const rewriteSeparator = "=>"
+
+// RewriteRule replaces matches of Pattern in resolved request URLs with
+// Replacement, which may refer to submatches (see regexp.Regexp.Expand).
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRewriteRule parses a rewrite rule in the format "pattern=>replacement".
+func ParseRewriteRule(value string) (rule RewriteRule, err error) {
+	i := strings.Index(value, rewriteSeparator)
+	if i < 0 {
+		err = fmt.Errorf("invalid rewrite rule '%s', expected pattern%sreplacement", value, rewriteSeparator)
+		return
+	}
+
+	rule.Replacement = value[i+len(rewriteSeparator):]
+	rule.Pattern, err = regexp.Compile(value[:i])
+	return
+}
+
+// rewriteURL applies all rewrite rules in order.
+func (d *Dumper) rewriteURL(u *url.URL) (*url.URL, error) {
+	if len(d.Rewrite) == 0 {
+		return u, nil
+	}
+
+	s := u.String()
+	for _, rule := range d.Rewrite {
+		s = rule.Pattern.ReplaceAllString(s, rule.Replacement)
+	}
+	if s == u.String() {
+		return u, nil
+	}
+	return url.Parse(s)
+}
@@ -0,0 +1,340 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage uploads the files to an S3-compatible object store when they
+// are closed, using path-style URLs (Endpoint/Bucket/Prefix/name) and
+// AWS Signature Version 4. Files larger than PartSize are uploaded with a
+// multipart upload.
+type S3Storage struct {
+	Endpoint *url.URL
+	Bucket   string
+	Prefix   string
+	Region   string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PartSize is the size of the parts of multipart uploads (default 64 MiB).
+	// S3 requires at least 5 MiB and allows at most 10000 parts, larger files
+	// are uploaded with larger parts.
+	PartSize int64
+	// Retry controls how failed requests are retried, with at most 3
+	// attempts if MaxAttempts is not set.
+	Retry RetryPolicy
+
+	Client *http.Client
+}
+
+const (
+	s3DefaultPartSize = 64 << 20
+	s3MaxParts        = 10000
+	s3DefaultAttempts = 3
+)
+
+// NewS3Storage returns a storage for s3://bucket/prefix. The credentials are
+// taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+// If endpoint is empty, the AWS endpoint for the region is used.
+func NewS3Storage(location, endpoint, region string) (s *S3Storage, err error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		err = fmt.Errorf("invalid S3 location: %s", location)
+		return
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	s = &S3Storage{
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       &http.Client{},
+	}
+	if s.Endpoint, err = url.Parse(endpoint); err != nil {
+		return
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		err = fmt.Errorf("missing S3 credentials (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)")
+	}
+	return
+}
+
+func (s *S3Storage) Create(name string) (File, error) {
+	return newSpoolFile(name, s.put)
+}
+
+func (s *S3Storage) Close() error {
+	return nil
+}
+
+// s3Escape encodes the path (or query parameter if slash is false)
+// as required for the canonical request.
+func s3Escape(p string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes the query sorted by name as required for the canonical request.
+func s3Query(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the AWS Signature Version 4 to the request, covering all
+// headers that are set. The payload is not signed unless its hash is
+// already set in X-Amz-Content-Sha256.
+func (s *S3Storage) sign(req *http.Request, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Storage) objectURL(name string, query url.Values) *url.URL {
+	key := name
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + name
+	}
+
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// do sends a signed request with size bytes from body and returns the
+// response if it was successful. Failed requests are retried.
+func (s *S3Storage) do(method string, u *url.URL, body io.ReadSeeker, size int64) (resp *http.Response, err error) {
+	retry := s.Retry
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = s3DefaultAttempts
+	}
+
+	start := time.Now()
+	for try := 1; ; try++ {
+		if resp, err = s.send(method, u, body, size); err == nil {
+			return
+		}
+		if retry.check(err, try, start) != nil {
+			return
+		}
+		time.Sleep(retry.backoff(try))
+	}
+}
+
+func (s *S3Storage) send(method string, u *url.URL, body io.ReadSeeker, size int64) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return
+	}
+	if size > 0 {
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		req.Body = ioutil.NopCloser(io.LimitReader(body, size))
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now())
+
+	if resp, err = s.Client.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		err = httpResponseStatusError(resp)
+		resp.Body.Close()
+		resp = nil
+	}
+	return
+}
+
+func (s *S3Storage) put(name string, r io.ReaderAt, size int64) (err error) {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = s3DefaultPartSize
+	}
+	if size > partSize {
+		return s.putMultipart(name, r, size, partSize)
+	}
+
+	resp, err := s.do(http.MethodPut, s.objectURL(name, nil), io.NewSectionReader(r, 0, size), size)
+	if err != nil {
+		return
+	}
+	return resp.Body.Close()
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads the file in parts, since single uploads are limited
+// to 5 GiB. The upload is aborted if any part fails.
+func (s *S3Storage) putMultipart(name string, r io.ReaderAt, size, partSize int64) (err error) {
+	if n := (size + s3MaxParts - 1) / s3MaxParts; n > partSize {
+		partSize = n
+	}
+
+	resp, err := s.do(http.MethodPost, s.objectURL(name, url.Values{"uploads": {""}}), nil, 0)
+	if err != nil {
+		return
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	upload := url.Values{"uploadId": {initiate.UploadID}}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Remove the parts that were already uploaded
+		if resp, aerr := s.do(http.MethodDelete, s.objectURL(name, upload), nil, 0); aerr == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	for n, offset := 1, int64(0); offset < size; n++ {
+		l := partSize
+		if size-offset < l {
+			l = size - offset
+		}
+		u := s.objectURL(name, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": upload["uploadId"]})
+		if resp, err = s.do(http.MethodPut, u, io.NewSectionReader(r, offset, l), l); err != nil {
+			return
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3Part{n, resp.Header.Get("ETag")})
+		offset += l
+	}
+
+	b, err := xml.Marshal(&complete)
+	if err != nil {
+		return
+	}
+	if resp, err = s.do(http.MethodPost, s.objectURL(name, upload), bytes.NewReader(b), int64(len(b))); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Completing the upload can also fail after the status was sent
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	if result.XMLName.Local == "Error" {
+		err = fmt.Errorf("failed to complete upload of %s: %s (%s)", name, result.Message, result.Code)
+	}
+	return
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+)
+
+type snapshotRecord struct {
+	RequestTime   time.Time   `json:"request_time"`
+	ResponseTime  time.Time   `json:"response_time"`
+	URL           string      `json:"url"`
+	RedirectedURL string      `json:"redirected_url,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+	File          string      `json:"file,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// snapshots store the raw response of each playlist reload in <name>-snapshots.
+// Identical bodies are only stored once, index.jsonl lists all reloads.
+type snapshots struct {
+	dir   string
+	index File
+	enc   *json.Encoder
+	files map[[sha1.Size]byte]string
+}
+
+func (s *stream) openSnapshots() (err error) {
+	sn := &s.playlist.snapshots
+	sn.dir = s.name + "-snapshots"
+	if sn.index, err = s.d.Storage.Create(path.Join(sn.dir, "index.jsonl")); err != nil {
+		return
+	}
+	sn.enc = json.NewEncoder(sn.index)
+	sn.files = make(map[[sha1.Size]byte]string)
+	return
+}
+
+func (s *stream) closeSnapshots() {
+	if s.playlist.snapshots.index != nil {
+		if err := s.playlist.snapshots.index.Close(); err != nil {
+			log.Println("Failed to close snapshot index:", err)
+		}
+	}
+}
+
+// snapshot records a playlist reload that was started at requestTime.
+// resp is nil if the request failed.
+func (s *stream) snapshot(req *http.Request, requestTime time.Time, resp *http.Response, body []byte, err error) {
+	sn := &s.playlist.snapshots
+	if sn.enc == nil {
+		if sn.dir != "" {
+			// Failed before
+			return
+		}
+		if oerr := s.openSnapshots(); oerr != nil {
+			log.Println("Failed to create snapshot archive:", oerr)
+			return
+		}
+	}
+
+	rec := &snapshotRecord{
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		URL:          req.URL.String(),
+	}
+	if resp != nil {
+		rec.Status = resp.StatusCode
+		rec.Header = resp.Header
+		if u := redirectedURL(resp); u != nil {
+			rec.RedirectedURL = u.String()
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	if len(body) > 0 {
+		sum := sha1.Sum(body)
+		if rec.File = sn.files[sum]; rec.File == "" {
+			rec.File = fmt.Sprintf("%d.m3u8", len(sn.files)+1)
+			if werr := writeFile(s.d.Storage, path.Join(sn.dir, rec.File), body); werr != nil {
+				log.Println("Failed to write playlist snapshot:", werr)
+				rec.File = ""
+			} else {
+				sn.files[sum] = rec.File
+			}
+		}
+	}
+
+	if eerr := sn.enc.Encode(rec); eerr != nil {
+		log.Println("Failed to write snapshot index:", eerr)
+	}
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Actions that can be used in Dumper.StallActions.
+const (
+	StallWarn   = "warn"
+	StallMarker = "marker"
+	StallHook   = "hook"
+	StallStop   = "stop"
+)
+
+// ErrStalled is returned by Dumper.Start if a stream was stopped because
+// its playlist stalled.
+var ErrStalled = errors.New("playlist stalled")
+
+type stallState struct {
+	segments time.Time // Last time new segments were found
+	sequence time.Time // Last time the playlist window had its usual size
+	window   int       // Usual size, known once the media sequence changed
+	pdt      time.Time // Last time the program date time advanced
+	lastPDT  time.Time
+	stalled  bool
+}
+
+// ParseStallActions parses a comma-separated list of stall actions.
+func ParseStallActions(value string) ([]string, error) {
+	actions := strings.Split(value, ",")
+	for _, action := range actions {
+		switch action {
+		case StallWarn, StallMarker, StallHook, StallStop:
+		default:
+			return nil, fmt.Errorf("invalid stall action: %s", action)
+		}
+	}
+	return actions, nil
+}
+
+// checkStall updates the stall detection after the playlist was loaded and
+// returns ErrStalled if the stream should be stopped.
+func (s *stream) checkStall(sequenceChanged bool, newSegments int, pdt time.Time) error {
+	now := time.Now()
+	st := &s.playlist.stall
+	if st.segments.IsZero() || newSegments > 0 {
+		st.segments = now
+		st.stalled = false
+	}
+	// The media sequence is stuck if the playlist keeps growing past its
+	// usual size without removing segments. Playlists that never removed
+	// a segment (e.g. EVENT playlists) may grow.
+	if sequenceChanged && !st.sequence.IsZero() {
+		st.window = s.playlist.segments
+	}
+	if st.sequence.IsZero() || st.window == 0 || s.playlist.segments <= st.window {
+		st.sequence = now
+	}
+	if st.pdt.IsZero() || pdt.After(st.lastPDT) {
+		st.pdt = now
+		st.lastPDT = pdt
+	}
+
+	if s.d.StallTimeout <= 0 || st.stalled || !s.playlist.active {
+		return nil
+	}
+
+	timeout := time.Duration(s.d.StallTimeout * float64(s.playlist.targetDuration))
+	var reason string
+	switch {
+	case now.Sub(st.segments) >= timeout:
+		reason = fmt.Sprintf("no new segments for %s", now.Sub(st.segments).Round(time.Second))
+	case now.Sub(st.sequence) >= timeout:
+		reason = fmt.Sprintf("media sequence stuck at %d for %s", s.playlist.sequence,
+			now.Sub(st.sequence).Round(time.Second))
+	case !st.lastPDT.IsZero() && now.Sub(st.pdt) >= timeout:
+		reason = fmt.Sprintf("program date time stuck at %s for %s", st.lastPDT.Format(time.RFC3339),
+			now.Sub(st.pdt).Round(time.Second))
+	default:
+		return nil
+	}
+
+	st.stalled = true
+	return s.stalled(reason)
+}
+
+func (s *stream) stalled(reason string) error {
+	actions := s.d.StallActions
+	if len(actions) == 0 {
+		actions = []string{StallWarn}
+	}
+
+	for _, action := range actions {
+		switch action {
+		case StallWarn:
+			log.Printf("Warning: Playlist %s stalled: %s\n", s.name, reason)
+		case StallMarker:
+			s.output.queue.c <- &segment{marker: "# STALLED: " + reason}
+		case StallHook:
+			if err := s.runStallCommand(reason); err != nil {
+				log.Println("Failed to run stall command:", err)
+			}
+		case StallStop:
+			log.Printf("Stopping stream %s: %s\n", s.name, reason)
+			return ErrStalled
+		}
+	}
+	return nil
+}
+
+// runStallCommand runs the stall command with the stream name, playlist
+// URL and reason in HLSDUMP_STREAM, HLSDUMP_URL and HLSDUMP_STALL.
+func (s *stream) runStallCommand(reason string) error {
+	args := strings.Fields(s.d.StallCommand)
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"HLSDUMP_STREAM="+s.name,
+		"HLSDUMP_URL="+s.playlistURL().String(),
+		"HLSDUMP_STALL="+reason)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckStall(t *testing.T) {
+	tests := []struct {
+		window          int
+		segments        int
+		sequenceChanged bool
+		newSegments     int
+		reason          string
+	}{
+		{5, 5, false, 0, "no new segments"},
+		{5, 5, true, 0, "no new segments"},
+		{5, 5, true, 1, ""},
+		{5, 8, true, 3, ""},  // The window grew, but it slides
+		{5, 5, false, 1, ""}, // Not larger than usual
+		{5, 6, false, 1, "media sequence stuck"},
+		{0, 6, false, 1, ""}, // Never slid, e.g. EVENT playlist
+		{0, 6, false, 0, "no new segments"},
+	}
+
+	for _, test := range tests {
+		s := &stream{d: &Dumper{StallTimeout: 2, StallActions: []string{StallMarker, StallStop}}}
+		s.output.queue.c = make(chan *segment, 1)
+		s.playlist.active = true
+		s.playlist.targetDuration = time.Second
+		s.playlist.segments = test.segments
+
+		// Last progress three target durations ago
+		past := time.Now().Add(-3 * time.Second)
+		st := &s.playlist.stall
+		st.segments = past
+		st.sequence = past
+		st.pdt = past
+		st.window = test.window
+
+		err := s.checkStall(test.sequenceChanged, test.newSegments, time.Time{})
+		var reason string
+		if err == ErrStalled {
+			reason = (<-s.output.queue.c).marker
+		}
+		if !strings.Contains(reason, test.reason) || (test.reason == "") != (reason == "") {
+			t.Errorf("checkStall(window %d, %d segments, sequence changed=%v, %d new) stalled with %q, want %q",
+				test.window, test.segments, test.sequenceChanged, test.newSegments, reason, test.reason)
+		}
+	}
+}
+
+func TestCheckStallFirstLoad(t *testing.T) {
+	s := &stream{d: &Dumper{}}
+	s.playlist.segments = 5
+
+	// The media sequence of the first load is not a change
+	_ = s.checkStall(true, 5, time.Time{})
+	if s.playlist.stall.window != 0 {
+		t.Errorf("window after first load = %d, want 0", s.playlist.stall.window)
+	}
+	_ = s.checkStall(true, 1, time.Time{})
+	if s.playlist.stall.window != 5 {
+		t.Errorf("window after sliding = %d, want 5", s.playlist.stall.window)
+	}
+}
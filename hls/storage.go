@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is an output file. Segments are resumed by seeking to the bytes
+// that were already written and truncated after they were downloaded.
+type File interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	// Close stores the finished file.
+	Close() error
+	// Abort discards the file, e.g. if the segment could not be downloaded.
+	Abort() error
+	Name() string
+}
+
+// Storage stores all output files (playlists, segments, keys and metadata).
+// Names are slash-separated paths relative to the output location.
+type Storage interface {
+	// Create creates or truncates the named file.
+	Create(name string) (File, error)
+	// Close is called when the dump has ended and all files are closed.
+	Close() error
+}
+
+// DirStorage stores the files in the directory Dir
+// (the current directory if empty).
+type DirStorage struct {
+	Dir string
+}
+
+func (s DirStorage) Create(name string) (File, error) {
+	name = filepath.Join(s.Dir, filepath.FromSlash(name))
+	if dir := filepath.Dir(name); dir != "." {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	f, err := createFileWriteOnly(name)
+	if err != nil {
+		return nil, err
+	}
+	return dirFile{f}, nil
+}
+
+func (s DirStorage) Close() error {
+	return nil
+}
+
+type dirFile struct {
+	*os.File
+}
+
+func (f dirFile) Abort() error {
+	err := f.File.Close()
+	if rerr := os.Remove(f.File.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// DiscardStorage discards all files.
+type DiscardStorage struct{}
+
+func (DiscardStorage) Create(name string) (File, error) {
+	return discardFile(name), nil
+}
+
+func (DiscardStorage) Close() error {
+	return nil
+}
+
+type discardFile string
+
+func (f discardFile) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f discardFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (f discardFile) Truncate(size int64) error {
+	return nil
+}
+
+func (f discardFile) Close() error {
+	return nil
+}
+
+func (f discardFile) Abort() error {
+	return nil
+}
+
+func (f discardFile) Name() string {
+	return string(f)
+}
+
+// spoolFile is written to a temporary file and passed to commit when it is
+// closed (but not when it is aborted). It is used for storage that cannot
+// be written at random offsets.
+type spoolFile struct {
+	*os.File
+	name   string
+	commit func(name string, r io.ReaderAt, size int64) error
+}
+
+func newSpoolFile(name string, commit func(string, io.ReaderAt, int64) error) (*spoolFile, error) {
+	f, err := ioutil.TempFile("", "hlsdump-")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolFile{File: f, name: name, commit: commit}, nil
+}
+
+func (f *spoolFile) Name() string {
+	return f.name
+}
+
+func (f *spoolFile) Close() (err error) {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+
+	size, err := f.File.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	return f.commit(f.name, f.File, size)
+}
+
+func (f *spoolFile) Abort() error {
+	err := f.File.Close()
+	if rerr := os.Remove(f.File.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// TarStorage writes the files to a tar archive as soon as they are closed.
+// Files that are still open when the dump ends (e.g. playlists) are added
+// at the end, so the archive can be streamed (e.g. to stdout).
+type TarStorage struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	tw *tar.Writer
+}
+
+func NewTarStorage(w io.WriteCloser) *TarStorage {
+	return &TarStorage{w: w, tw: tar.NewWriter(w)}
+}
+
+func (s *TarStorage) Create(name string) (File, error) {
+	return newSpoolFile(name, s.add)
+}
+
+func (s *TarStorage) add(name string, r io.ReaderAt, size int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return
+	}
+	if _, err = io.Copy(s.tw, io.NewSectionReader(r, 0, size)); err != nil {
+		return
+	}
+	return s.tw.Flush()
+}
+
+func (s *TarStorage) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.tw.Close()
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// ParseStorage returns the storage for a location: a directory, tar:<file>
+// for a tar archive (tar:- for stdout) or s3://bucket/prefix.
+func ParseStorage(location, s3Endpoint, s3Region string) (Storage, error) {
+	switch {
+	case strings.HasPrefix(location, "tar:"):
+		name := strings.TrimPrefix(location, "tar:")
+		if name == "-" {
+			return NewTarStorage(os.Stdout), nil
+		}
+		f, err := createFileWriteOnly(name)
+		if err != nil {
+			return nil, err
+		}
+		return NewTarStorage(f), nil
+	case strings.HasPrefix(location, "s3:"):
+		return NewS3Storage(location, s3Endpoint, s3Region)
+	default:
+		return DirStorage{Dir: location}, nil
+	}
+}
+
+// writeFile stores b in the named file.
+func writeFile(s Storage, name string, b []byte) (err error) {
+	f, err := s.Create(name)
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Abort()
+		return
+	}
+	return f.Close()
+}
+
+func (d *Dumper) initStorage() {
+	if d.Storage == nil {
+		d.Storage = DirStorage{}
+	}
+}
+
+// outputStorage returns the storage for the playlists, segments and keys.
+func (d *Dumper) outputStorage() Storage {
+	if d.WARCOnly {
+		return DiscardStorage{}
+	}
+	return d.Storage
+}
+
+func (d *Dumper) closeStorage() {
+	if err := d.Storage.Close(); err != nil {
+		log.Println("Failed to close storage:", err)
+	}
+}
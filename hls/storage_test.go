@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestTarStorageAbort(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewTarStorage(nopWriteCloser{&buf})
+
+	if err := writeFile(s, "done.ts", []byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.Create("partial.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("part"))
+	if err = f.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) != 1 || names[0] != "done.ts" {
+		t.Errorf("archive contains %q, want only done.ts", names)
+	}
+}
+
+func TestDirStorageAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := DirStorage{Dir: dir}
+	f, err := s.Create("a/partial.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("part"))
+	if err = f.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "a", "partial.ts")); !os.IsNotExist(err) {
+		t.Errorf("aborted file was kept: %v", err)
+	}
+}
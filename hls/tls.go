@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const pinPrefix = "sha256//"
+
+var (
+	errInvalidCABundle = errors.New("no certificates found in CA bundle")
+	errPinMismatch     = errors.New("no certificate matches the pinned public keys")
+)
+
+// TLSOptions configures certificate verification and client certificates.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of CAs that are trusted instead of the system CAs.
+	CAFile string
+	// CertFile and KeyFile contain a PEM client certificate and key.
+	CertFile string
+	KeyFile  string
+
+	MinVersion uint16
+	// ServerNames overrides the server name used for SNI and verification
+	// of a host. It does not apply to connections through HTTP proxies.
+	ServerNames map[string]string
+
+	// Pins are base64 SHA-256 hashes of public keys (SPKI), optionally
+	// prefixed with "sha256//". At least one certificate in the chain
+	// must match one of them.
+	Pins               []string
+	InsecureSkipVerify bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func ParseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersions[v]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version: %s", v)
+}
+
+// ParseServerNames parses a list of host=name pairs.
+func ParseServerNames(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]string, len(values))
+	for _, value := range values {
+		host, name := splitPair(value, '=')
+		if host == "" || name == "" {
+			return nil, fmt.Errorf("invalid server name '%s', expected host=name", value)
+		}
+		m[strings.ToLower(host)] = name
+	}
+	return m, nil
+}
+
+func (o *TLSOptions) apply(c *tls.Config) (err error) {
+	c.MinVersion = o.MinVersion
+	c.InsecureSkipVerify = o.InsecureSkipVerify
+
+	if o.CAFile != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(o.CAFile); err != nil {
+			return
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return errInvalidCABundle
+		}
+	}
+
+	if o.CertFile != "" {
+		keyFile := o.KeyFile
+		if keyFile == "" {
+			keyFile = o.CertFile
+		}
+
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(o.CertFile, keyFile); err != nil {
+			return
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(o.Pins) > 0 {
+		pins := make(map[string]struct{}, len(o.Pins))
+		for _, pin := range o.Pins {
+			pins[strings.TrimPrefix(pin, pinPrefix)] = struct{}{}
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if _, ok := pins[publicKeyPin(cert)]; ok {
+					return nil
+				}
+			}
+			return errPinMismatch
+		}
+	}
+	return
+}
+
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func logTLS(resp *http.Response) {
+	cs := resp.TLS
+	if cs == nil {
+		return
+	}
+
+	log.Printf("TLS: %s, %s, ALPN %q, resumed %t\n", tlsVersionName(cs.Version),
+		tls.CipherSuiteName(cs.CipherSuite), cs.NegotiatedProtocol, cs.DidResume)
+	for _, cert := range cs.PeerCertificates {
+		log.Printf("TLS: Certificate %q issued by %q, pin %s%s\n", cert.Subject, cert.Issuer,
+			pinPrefix, publicKeyPin(cert))
+	}
+}
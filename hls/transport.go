@@ -0,0 +1,360 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxRedirects = 10
+
+// RedirectPolicy controls how HTTP redirects are followed. Relative URIs
+// in playlists are always resolved against the URL after redirects.
+type RedirectPolicy struct {
+	// MaxRedirects limits the number of redirects per request
+	// (0 = 10, negative = do not follow redirects).
+	MaxRedirects int
+	// SameHost rejects redirects to other hosts.
+	SameHost bool
+	// Reuse reloads media playlists from the redirected URL.
+	Reuse bool
+}
+
+func (p *RedirectPolicy) check(req *http.Request, via []*http.Request) error {
+	max := p.MaxRedirects
+	if max == 0 {
+		max = defaultMaxRedirects
+	} else if max < 0 {
+		return http.ErrUseLastResponse
+	}
+
+	if len(via) >= max {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if p.SameHost && req.URL.Host != via[0].URL.Host {
+		return fmt.Errorf("redirect to other host rejected: %s", req.URL.Host)
+	}
+	return nil
+}
+
+// redirectedURL returns the final URL of a response if the request was
+// redirected, otherwise nil.
+func redirectedURL(resp *http.Response) *url.URL {
+	if resp.Request.Response != nil {
+		return resp.Request.URL
+	}
+	return nil
+}
+
+// HostProxy selects a proxy for hosts matching a host pattern.
+// A nil Proxy or one with the scheme ProxyDirect connects directly.
+type HostProxy struct {
+	Host  string
+	Proxy *url.URL
+}
+
+// TransportOptions configures the HTTP transport that is shared by all
+// requests of a Dumper. Zero values keep the defaults of net/http.
+type TransportOptions struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	DisableHTTP2       bool
+	DisableKeepAlives  bool
+	DisableCompression bool
+
+	// TLSSessionCacheSize is the number of TLS sessions that are cached
+	// for resumption (0 = disabled).
+	TLSSessionCacheSize int
+
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	ExpectContinueTimeout time.Duration
+
+	// Proxy is used for all requests, unless the host matches a pattern in
+	// NoProxy or HostProxies. If nil, the proxy is taken from the environment.
+	// Supported schemes are http, https, socks5, socks5h and ProxyDirect.
+	Proxy       *url.URL
+	NoProxy     []string
+	HostProxies []HostProxy
+
+	TLS TLSOptions
+
+	// Resolve overrides the address used for host:port (like curl --resolve).
+	Resolve map[string]string
+	// Interface is the source IP address or network interface
+	// used for all connections.
+	Interface string
+	// IPVersion prefers IPv4 (4) or IPv6 (6) addresses if set.
+	IPVersion int
+}
+
+// ParseResolve parses a list of host:port:addr entries.
+func ParseResolve(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]string, len(values))
+	for _, value := range values {
+		host, v := splitPair(value, ':')
+		port, addr := splitPair(v, ':')
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if host == "" || port == "" || net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid resolve entry '%s', expected host:port:addr", value)
+		}
+		m[net.JoinHostPort(host, port)] = addr
+	}
+	return m, nil
+}
+
+func (o *TransportOptions) localAddr() (*net.TCPAddr, error) {
+	if o.Interface == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(o.Interface); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == (o.IPVersion != 6) {
+			return &net.TCPAddr{IP: ipnet.IP}, nil
+		}
+		if fallback == nil {
+			fallback = ipnet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no usable address on interface %s", o.Interface)
+	}
+	return &net.TCPAddr{IP: fallback}, nil
+}
+
+func (o *TransportOptions) dialer() (func(context.Context, string, string) (net.Conn, error), error) {
+	localAddr, err := o.localAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if localAddr != nil {
+		d.LocalAddr = localAddr
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if a, ok := o.Resolve[addr]; ok {
+			_, port, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(a, port)
+		}
+
+		if o.IPVersion == 4 || o.IPVersion == 6 {
+			conn, err := d.DialContext(ctx, network+strconv.Itoa(o.IPVersion), addr)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+		}
+		return d.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// dialTLS returns a function that establishes TLS connections using the
+// server name from TLS.ServerNames for the host, if there is one.
+func (o *TransportOptions) dialTLS(t *http.Transport) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := t.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, _ := net.SplitHostPort(addr)
+		c := t.TLSClientConfig.Clone()
+		c.ServerName = host
+		if name, ok := o.TLS.ServerNames[strings.ToLower(host)]; ok {
+			c.ServerName = name
+		}
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		if t.TLSHandshakeTimeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(t.TLSHandshakeTimeout))
+		}
+		tlsConn := tls.Client(conn, c)
+		err = tlsConn.Handshake()
+		_ = conn.SetDeadline(time.Time{})
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func (o *TransportOptions) proxy(req *http.Request) (*url.URL, error) {
+	for _, p := range o.HostProxies {
+		if matchHost(p.Host, req.URL) {
+			return directProxy(p.Proxy), nil
+		}
+	}
+	for _, pattern := range o.NoProxy {
+		if matchHost(pattern, req.URL) {
+			return nil, nil
+		}
+	}
+	if o.Proxy != nil {
+		return directProxy(o.Proxy), nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// ProxyDirect is the scheme of proxy URLs that connect directly,
+// without taking the proxy from the environment.
+const ProxyDirect = "direct"
+
+func directProxy(u *url.URL) *url.URL {
+	if u != nil && u.Scheme == ProxyDirect {
+		return nil
+	}
+	return u
+}
+
+// ParseProxy parses a proxy URL. The scheme defaults to http,
+// "direct" disables the proxy.
+func ParseProxy(value string) (*url.URL, error) {
+	if value == ProxyDirect {
+		return &url.URL{Scheme: ProxyDirect}, nil
+	}
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	return u, nil
+}
+
+// ParseHostProxies parses a list of host=proxy pairs.
+func ParseHostProxies(values []string) (proxies []HostProxy, err error) {
+	for _, value := range values {
+		host, proxy := splitPair(value, '=')
+		p := HostProxy{Host: host}
+		if p.Proxy, err = ParseProxy(proxy); err != nil {
+			err = fmt.Errorf("invalid proxy for %s: %s", host, err)
+			return
+		}
+		proxies = append(proxies, p)
+	}
+	return
+}
+
+func (o *TransportOptions) newTransport() (*http.Transport, error) {
+	dial, err := o.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = o.proxy
+	t.DialContext = dial
+	t.DisableKeepAlives = o.DisableKeepAlives
+	t.DisableCompression = o.DisableCompression
+
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.ExpectContinueTimeout > 0 {
+		t.ExpectContinueTimeout = o.ExpectContinueTimeout
+	}
+
+	t.TLSClientConfig = &tls.Config{}
+	if o.TLSSessionCacheSize > 0 {
+		t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(o.TLSSessionCacheSize)
+	}
+	if err := o.TLS.apply(t.TLSClientConfig); err != nil {
+		return nil, err
+	}
+
+	if len(o.TLS.ServerNames) > 0 {
+		t.DialTLSContext = o.dialTLS(t)
+	}
+
+	if o.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t, nil
+}
+
+func (d *Dumper) initTransport() (err error) {
+	if d.RoundTripper == nil {
+		if d.WARC != "" {
+			// Archive the responses as they were sent by the server
+			d.Transport.DisableCompression = true
+		}
+		d.RoundTripper, err = d.Transport.newTransport()
+	}
+	return
+}
+
+func (d *Dumper) newClient(timeout time.Duration) http.Client {
+	return http.Client{
+		Transport:     d.RoundTripper,
+		CheckRedirect: d.Redirect.check,
+		Jar:           d.Jar,
+		Timeout:       timeout,
+	}
+}
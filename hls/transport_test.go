@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		match   bool
+	}{
+		{"example.com", "http://example.com/a.m3u8", true},
+		{"example.com", "http://cdn.example.com/a.m3u8", true},
+		{"example.com", "http://notexample.com/a.m3u8", false},
+		{".example.com", "http://cdn.example.com/a.m3u8", true},
+		{"*.example.com", "http://cdn.example.com/a.m3u8", true},
+		{"EXAMPLE.com", "http://Example.COM/a.m3u8", true},
+		{"*", "http://anything.test/a.m3u8", true},
+		{"10.0.0.0/8", "http://10.1.2.3/a.m3u8", true},
+		{"10.0.0.0/8", "http://11.1.2.3/a.m3u8", false},
+		{"10.0.0.0/8", "http://ten.example/a.m3u8", false},
+		{"example.com:8080", "http://example.com:8080/a.m3u8", true},
+		{"example.com:8080", "http://example.com:8081/a.m3u8", false},
+		{"example.com:8080", "http://example.com/a.m3u8", false},
+		{"example.com:443", "https://example.com/a.m3u8", true},
+		{"example.com:80", "https://example.com/a.m3u8", false},
+		{"*:8080", "http://other.test:8080/a.m3u8", true},
+		{"[::1]:8080", "http://[::1]:8080/a.m3u8", true},
+		{"::1", "http://[::1]:8080/a.m3u8", true},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := matchHost(test.pattern, u); match != test.match {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", test.pattern, test.url, match, test.match)
+		}
+	}
+}
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   map[string]string
+		err    bool
+	}{
+		{nil, nil, false},
+		{[]string{"example.com:443:10.0.0.1"}, map[string]string{"example.com:443": "10.0.0.1"}, false},
+		{[]string{"example.com:80:[2001:db8::1]"}, map[string]string{"example.com:80": "2001:db8::1"}, false},
+		{[]string{"example.com:80:2001:db8::1"}, map[string]string{"example.com:80": "2001:db8::1"}, false},
+		{[]string{"example.com:443"}, nil, true},
+		{[]string{"example.com:443:invalid"}, nil, true},
+		{[]string{":443:10.0.0.1"}, nil, true},
+	}
+
+	for _, test := range tests {
+		m, err := ParseResolve(test.values)
+		if (err != nil) != test.err {
+			t.Errorf("ParseResolve(%q) returned error %v", test.values, err)
+			continue
+		}
+		if len(m) != len(test.want) {
+			t.Errorf("ParseResolve(%q) = %v, want %v", test.values, m, test.want)
+			continue
+		}
+		for k, v := range test.want {
+			if m[k] != v {
+				t.Errorf("ParseResolve(%q) = %v, want %v", test.values, m, test.want)
+			}
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	os.Setenv("HTTP_PROXY", "http://env-proxy:3128")
+	defer os.Unsetenv("HTTP_PROXY")
+
+	direct, err := ParseProxy("direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks, err := ParseProxy("socks5://localhost:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseProxy("ftp://localhost"); err == nil {
+		t.Error("ParseProxy accepted unsupported scheme")
+	}
+
+	tests := []struct {
+		options TransportOptions
+		url     string
+		proxy   string
+	}{
+		{TransportOptions{Proxy: direct}, "http://example.com/", ""},
+		{TransportOptions{Proxy: socks}, "http://example.com/", "socks5://localhost:1080"},
+		{TransportOptions{Proxy: socks, NoProxy: []string{"example.com"}}, "http://cdn.example.com/", ""},
+		{TransportOptions{Proxy: socks, NoProxy: []string{"example.com:8080"}}, "http://example.com/", "socks5://localhost:1080"},
+		{TransportOptions{Proxy: socks, HostProxies: []HostProxy{{"example.com", direct}}}, "http://example.com/", ""},
+		{TransportOptions{HostProxies: []HostProxy{{"example.com", socks}}}, "http://example.com/", "socks5://localhost:1080"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := test.options.proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var proxy string
+		if u != nil {
+			proxy = u.String()
+		}
+		if proxy != test.proxy {
+			t.Errorf("proxy for %s = %q, want %q", test.url, proxy, test.proxy)
+		}
+	}
+}
+
+func TestParseServerNames(t *testing.T) {
+	m, err := ParseServerNames([]string{"CDN.example.com=origin.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["cdn.example.com"] != "origin.example.com" || len(m) != 1 {
+		t.Errorf("ParseServerNames = %v", m)
+	}
+	for _, value := range []string{"example.com", "=name", "example.com="} {
+		if _, err = ParseServerNames([]string{value}); err == nil {
+			t.Errorf("ParseServerNames accepted %q", value)
+		}
+	}
+}
+
+func TestServerNames(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	// The test certificate is valid for example.com and 127.0.0.1
+	o := &TransportOptions{
+		Proxy: &url.URL{Scheme: ProxyDirect},
+		TLS: TLSOptions{
+			CAFile:      writeTestFile(t, dir, "ca.pem", string(ca)),
+			ServerNames: map[string]string{"localhost": "example.com"},
+		},
+	}
+	tr, err := o.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	port := srv.URL[strings.LastIndexByte(srv.URL, ':'):]
+	tests := []struct {
+		host       string
+		serverName string
+	}{
+		{"localhost", "example.com"},
+		{"127.0.0.1", ""},
+	}
+	for _, test := range tests {
+		resp, err := client.Get("https://" + test.host + port + "/")
+		if err != nil {
+			t.Errorf("request to %s failed: %s", test.host, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.serverName {
+			t.Errorf("server name for %s = %q, want %q", test.host, b, test.serverName)
+		}
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/textproto"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type fatalError struct {
@@ -19,13 +23,7 @@ type fatalError struct {
 }
 
 func (d *Dumper) newRequest(url string) (req *http.Request, err error) {
-	if req, err = http.NewRequest(http.MethodGet, url, nil); err != nil {
-		return
-	}
-
-	for k, v := range d.Headers {
-		req.Header[k] = v
-	}
+	req, err = http.NewRequest(http.MethodGet, url, nil)
 	return
 }
 
@@ -39,11 +37,38 @@ func fatal(err error) error {
 func httpResponseStatusError(resp *http.Response) (err error) {
 	_, _ = io.Copy(ioutil.Discard, resp.Body) // Discard body
 
-	err = fmt.Errorf("server returned HTTP status code %d (%s) for %s",
-		resp.StatusCode, http.StatusText(resp.StatusCode), resp.Request.URL)
-	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode < http.StatusInternalServerError &&
-		resp.StatusCode != http.StatusTooManyRequests {
-		err = fatalError{err, false}
+	err = statusError{
+		error: fmt.Errorf("server returned HTTP status code %d (%s) for %s",
+			resp.StatusCode, http.StatusText(resp.StatusCode), resp.Request.URL),
+		code: resp.StatusCode,
+	}
+	return
+}
+
+// QueryAll can be used in Dumper.PropagateQuery to propagate all parameters.
+const QueryAll = "*"
+
+// resolveURL resolves ref relative to base and adds the propagated query
+// parameters that are not already present.
+func (d *Dumper) resolveURL(base *url.URL, ref string, query url.Values) (u *url.URL, err error) {
+	if u, err = base.Parse(ref); err != nil || len(d.PropagateQuery) == 0 || len(query) == 0 {
+		return
+	}
+
+	// Append to the existing query to keep the order of signed parameters
+	q := u.Query()
+	extra := url.Values{}
+	for k, v := range query {
+		if _, ok := q[k]; ok || !(contains(d.PropagateQuery, QueryAll) || contains(d.PropagateQuery, k)) {
+			continue
+		}
+		extra[k] = v
+	}
+	if len(extra) > 0 {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += extra.Encode()
 	}
 	return
 }
@@ -59,6 +84,15 @@ func eofIfNil(err error) error {
 	return err
 }
 
+// parseDuration parses a decimal number of seconds.
+func parseDuration(v string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
 func contains(s []string, b string) bool {
 	for _, a := range s {
 		if a == b {
@@ -68,6 +102,44 @@ func contains(s []string, b string) bool {
 	return false
 }
 
+// matchHost reports whether the host of u matches the pattern. Patterns
+// match the host itself and all subdomains, "*" matches all hosts and IP
+// addresses can also be matched by CIDR notation. If the pattern has a port,
+// it must match the port of u (or the default port of its scheme).
+func matchHost(pattern string, u *url.URL) bool {
+	pattern = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), "."))
+	host := strings.ToLower(u.Hostname())
+
+	if h, port, err := net.SplitHostPort(pattern); err == nil {
+		if port != urlPort(u) {
+			return false
+		}
+		pattern = strings.TrimPrefix(strings.TrimPrefix(h, "*"), ".")
+	}
+	if pattern == "" {
+		return true
+	}
+
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && network.Contains(ip)
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
 func splitPair(s string, c byte) (string, string) {
 	i := strings.IndexByte(s, c)
 	if i > 0 {
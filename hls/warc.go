@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// warc writes all HTTP exchanges as WARC/1.1 request and response records.
+type warc struct {
+	mu sync.Mutex
+	f  File
+	w  *bufio.Writer
+}
+
+type warcField struct {
+	name, value string
+}
+
+func warcRecordID() (id string, err error) {
+	var b [16]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // Variant
+	id = fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return
+}
+
+func warcDigest(sum []byte) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum)
+}
+
+func (d *Dumper) openWARC() (err error) {
+	if d.WARC == "" {
+		return
+	}
+
+	id, err := warcRecordID()
+	if err != nil {
+		return
+	}
+	f, err := d.Storage.Create(d.WARC)
+	if err != nil {
+		return
+	}
+	d.warc = &warc{f: f, w: bufio.NewWriter(f)}
+
+	info := []byte("software: hlsdump\r\nformat: WARC File Format 1.1\r\n")
+	return d.warc.write([]warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", id},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+		{"Content-Type", "application/warc-fields"},
+	}, bytes.NewReader(info), int64(len(info)))
+}
+
+func (d *Dumper) closeWARC() {
+	if d.warc == nil {
+		return
+	}
+
+	d.warc.mu.Lock()
+	defer d.warc.mu.Unlock()
+	err := d.warc.w.Flush()
+	if cerr := d.warc.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Failed to close WARC file:", err)
+	}
+}
+
+// write writes a record with a block of the given length.
+func (w *warc) write(fields []warcField, block io.Reader, length int64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err = w.w.WriteString("WARC/1.1\r\n"); err != nil {
+		return
+	}
+	for _, f := range fields {
+		if _, err = fmt.Fprintf(w.w, "%s: %s\r\n", f.name, f.value); err != nil {
+			return
+		}
+	}
+	if _, err = fmt.Fprintf(w.w, "Content-Length: %d\r\n\r\n", length); err != nil {
+		return
+	}
+	if _, err = io.CopyN(w.w, block, length); err != nil {
+		return
+	}
+	if _, err = w.w.WriteString("\r\n\r\n"); err != nil {
+		return
+	}
+	return w.w.Flush()
+}
+
+// writeExchange writes the request and response records for the body.
+// payload is the part of the response body that was read.
+func (w *warc) writeExchange(b *warcBody, payload io.Reader, truncated string) (err error) {
+	requestID, err := warcRecordID()
+	if err != nil {
+		return
+	}
+	responseID, err := warcRecordID()
+	if err != nil {
+		return
+	}
+
+	req := b.resp.Request
+	date := time.Now().UTC().Format(time.RFC3339)
+	target := req.URL.String()
+
+	response := []warcField{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target},
+		{"WARC-Concurrent-To", requestID},
+	}
+	if host, _, err := net.SplitHostPort(b.remoteAddr); err == nil {
+		response = append(response, warcField{"WARC-IP-Address", host})
+	}
+	response = append(response,
+		warcField{"WARC-Block-Digest", warcDigest(b.blockDigest.Sum(nil))},
+		warcField{"WARC-Payload-Digest", warcDigest(b.payloadDigest.Sum(nil))},
+		warcField{"Content-Type", "application/http; msgtype=response"},
+	)
+	if truncated != "" {
+		response = append(response, warcField{"WARC-Truncated", truncated})
+	}
+	if err = w.write(response, io.MultiReader(bytes.NewReader(b.header), payload),
+		int64(len(b.header))+b.size); err != nil {
+		return
+	}
+
+	var reqBlock bytes.Buffer
+	fmt.Fprintf(&reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	redactHeaders(req.Header).Write(&reqBlock)
+	reqBlock.WriteString("\r\n")
+	sum := sha1.Sum(reqBlock.Bytes())
+
+	return w.write([]warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", requestID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target},
+		{"WARC-Concurrent-To", responseID},
+		{"WARC-Block-Digest", warcDigest(sum[:])},
+		{"Content-Type", "application/http; msgtype=request"},
+	}, &reqBlock, int64(reqBlock.Len()))
+}
+
+// warcBody copies the response body to a temporary file while it is read
+// and writes the exchange to the WARC file when the body is closed.
+type warcBody struct {
+	io.ReadCloser
+	w          *warc
+	resp       *http.Response
+	remoteAddr string
+	header     []byte
+
+	payload       *os.File
+	size          int64
+	blockDigest   hash.Hash
+	payloadDigest hash.Hash
+	readErr       error
+	spoolErr      error
+	once          sync.Once
+}
+
+func (w *warc) newBody(resp *http.Response, remoteAddr string) *warcBody {
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "%s %s\r\n", resp.Proto, resp.Status)
+	resp.Header.Write(&header)
+	header.WriteString("\r\n")
+
+	b := &warcBody{
+		ReadCloser:    resp.Body,
+		w:             w,
+		resp:          resp,
+		remoteAddr:    remoteAddr,
+		header:        header.Bytes(),
+		blockDigest:   sha1.New(),
+		payloadDigest: sha1.New(),
+	}
+	b.blockDigest.Write(b.header)
+	return b
+}
+
+func (b *warcBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.spool(p[:n])
+	}
+	if err != nil && b.readErr == nil {
+		b.readErr = err
+	}
+	return
+}
+
+func (b *warcBody) spool(p []byte) {
+	if b.spoolErr != nil {
+		return
+	}
+	if b.payload == nil {
+		if b.payload, b.spoolErr = ioutil.TempFile("", "hlsdump-warc-"); b.spoolErr != nil {
+			return
+		}
+	}
+	if _, b.spoolErr = b.payload.Write(p); b.spoolErr != nil {
+		return
+	}
+	b.blockDigest.Write(p)
+	b.payloadDigest.Write(p)
+	b.size += int64(len(p))
+}
+
+// Close writes the records. The rest of the body is not read if the
+// download was aborted, the response record is marked as truncated instead.
+func (b *warcBody) Close() error {
+	b.once.Do(b.archive)
+	return b.ReadCloser.Close()
+}
+
+func (b *warcBody) archive() {
+	if b.payload != nil {
+		defer os.Remove(b.payload.Name())
+		defer b.payload.Close()
+	}
+
+	err := b.spoolErr
+	var payload io.Reader = bytes.NewReader(nil)
+	if err == nil && b.payload != nil {
+		_, err = b.payload.Seek(0, io.SeekStart)
+		payload = b.payload
+	}
+	if err == nil {
+		var truncated string
+		if b.readErr != nil && b.readErr != io.EOF {
+			truncated = "disconnect"
+		} else if b.readErr == nil && b.size != b.resp.ContentLength {
+			truncated = "unspecified"
+		}
+		err = b.w.writeExchange(b, payload, truncated)
+	}
+	if err != nil {
+		log.Println("Failed to write WARC records:", err)
+	}
+}
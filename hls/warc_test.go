@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2019 Stephan Gerhold
+package hls
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWARCBody(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "hlsdump-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Dumper{Storage: DirStorage{Dir: dir}, WARC: "test.warc"}
+	if err = d.openWARC(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		read      int64
+		truncated string
+	}{
+		{-1, ""},
+		{100, "unspecified"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "session=secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := d.warc.newBody(resp, "")
+		if test.read < 0 {
+			_, err = io.Copy(ioutil.Discard, body)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, body, test.read)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+
+		if test.read >= 0 && body.size != test.read {
+			t.Errorf("archived %d bytes after reading %d bytes", body.size, test.read)
+		}
+	}
+	d.closeWARC()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "test.warc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") ||
+		!strings.Contains(string(b), "Authorization: (redacted)\r\n") {
+		t.Error("credentials are not redacted in the request records")
+	}
+
+	records := strings.Split(string(b), "WARC/1.1\r\n")[1:]
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(records))
+	}
+	for i, test := range tests {
+		header := records[1+2*i][:strings.Index(records[1+2*i], "\r\n\r\n")]
+		if !strings.Contains(header, "WARC-Type: response\r\n") {
+			t.Errorf("record %d is not a response", 1+2*i)
+		}
+		var truncated string
+		if j := strings.Index(header, "WARC-Truncated: "); j >= 0 {
+			truncated = strings.SplitN(header[j+16:], "\r\n", 2)[0]
+		}
+		if truncated != test.truncated {
+			t.Errorf("response %d has WARC-Truncated '%s', want '%s'", i, truncated, test.truncated)
+		}
+	}
+	if !strings.Contains(records[1], "WARC-Payload-Digest: "+warcDigest(sha1Sum(data))+"\r\n") {
+		t.Error("wrong payload digest")
+	}
+}
+
+func sha1Sum(b []byte) []byte {
+	h := sha1.Sum(b)
+	return h[:]
+}
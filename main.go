@@ -3,6 +3,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"hlsdump/hls"
@@ -12,6 +13,7 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type listFlag []string
@@ -31,15 +33,45 @@ func usage() {
 	os.Exit(2)
 }
 
+func checkUsage(err error) {
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(2)
+	}
+}
+
 func parse() *hls.Dumper {
 	var name string
 	flag.StringVar(&name, "name", "", "Output file name prefix (without file extension)")
 	singleFile := flag.Bool("single-file", false, "Store segments in single file (using EXT-X-BYTERANGE)")
 	verbose := flag.Bool("verbose", false, "Verbose output")
+	storage := flag.String("storage", "", "Store output files in a directory, tar archive (tar:<file>, tar:- for stdout) or S3-compatible object store (s3://bucket/prefix)")
+	s3Endpoint := flag.String("s3-endpoint", "", "Endpoint URL of the S3-compatible object store (default: AWS endpoint for the region)")
+	s3Region := flag.String("s3-region", "us-east-1", "Region of the S3-compatible object store")
+	outputDir := flag.String("output-dir", "", "Directory for all output files")
+	playlistTemplate := flag.String("playlist-template", "", "Name of the output playlists (default {name}.m3u8), may contain directories and the placeholders {name}, {index}, {bandwidth}, {resolution}, {group} and {language}")
+	segmentTemplate := flag.String("segment-template", "", "Name of the segment files (default {name}-{seq}{ext} or {name}{ext} with -single-file), must contain {seq} (except with -single-file), may contain directories, the playlist placeholders and {dseq}, {pdt}, {uri} and {ext}")
+	extension := flag.String("extension", "", "File extension of the segments (default: derived from the segment URI or Content-Type)")
+	mirror := flag.Bool("mirror", false, "Store all files (including keys and init sections) at paths derived from their URLs (host/path) and make absolute URIs in playlists relative")
 
 	var headers listFlag
 	flag.Var(&headers, "header", "Additional HTTP headers to use for HTTP(s) requests")
 
+	var headerRules listFlag
+	flag.Var(&headerRules, "header-rule", "Additional HTTP header for specific hosts and request kinds (e.g. 'cdn.example.com/segment,key X-Token: abc')")
+
+	user := flag.String("user", "", "Basic authentication (user:password) for the host of the master playlist")
+	bearer := flag.String("bearer", "", "Bearer token for the host of the master playlist")
+
+	var authHosts listFlag
+	flag.Var(&authHosts, "auth-host", "Additional host that receives authentication and cookie headers")
+
+	netrc := flag.Bool("netrc", false, "Use Basic authentication from ~/.netrc")
+	netrcFile := flag.String("netrc-file", "", "Use Basic authentication from the specified .netrc file")
+
+	var rewrites listFlag
+	flag.Var(&rewrites, "rewrite", "Rewrite request URLs using a regular expression (pattern=>replacement, applied in order)")
+
 	var groups listFlag
 	flag.Var(&groups, "group", "Only download streams that use the specified rendition group IDs")
 
@@ -48,6 +80,84 @@ func parse() *hls.Dumper {
 
 	playlistTimeout := flag.Duration("playlist-timeout", -1, "Timeout for playlist download")
 	segmentTimeout := flag.Int("segment-timeout", -1, "Timeout multiplier for segment download")
+	var transport hls.TransportOptions
+	flag.IntVar(&transport.MaxIdleConns, "max-idle-conns", 0, "Maximum number of idle HTTP connections (0 = default)")
+	flag.IntVar(&transport.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "Maximum number of idle HTTP connections per host (0 = default)")
+	flag.IntVar(&transport.MaxConnsPerHost, "max-conns-per-host", 0, "Maximum number of HTTP connections per host (0 = unlimited)")
+	flag.DurationVar(&transport.IdleConnTimeout, "idle-conn-timeout", 0, "Timeout for idle HTTP connections (0 = default)")
+	http2 := flag.Bool("http2", true, "Use HTTP/2 if supported by the server")
+	keepAlive := flag.Bool("keep-alive", true, "Reuse HTTP connections for multiple requests")
+	flag.IntVar(&transport.TLSSessionCacheSize, "tls-session-cache", 64, "Number of cached TLS sessions for resumption (0 = disabled)")
+	flag.DurationVar(&transport.TLSHandshakeTimeout, "tls-handshake-timeout", 0, "Timeout for TLS handshakes (0 = default)")
+	flag.DurationVar(&transport.ResponseHeaderTimeout, "response-header-timeout", 0, "Timeout for receiving HTTP response headers (0 = unlimited)")
+	flag.DurationVar(&transport.ExpectContinueTimeout, "expect-continue-timeout", 0, "Timeout for HTTP 100-continue responses (0 = default)")
+
+	proxy := flag.String("proxy", "", "Proxy for all requests (http://, https:// or socks5://[user:password@]host:port)")
+
+	var noProxy listFlag
+	flag.Var(&noProxy, "no-proxy", "Hosts (including subdomains, optionally with :port) that are accessed without proxy (comma-separated)")
+
+	var hostProxies listFlag
+	flag.Var(&hostProxies, "proxy-host", "Proxy for specific hosts (e.g. example.com=socks5://localhost:1080 or example.com=direct)")
+
+	cookies := flag.String("cookies", "", "Load cookies from a Netscape cookies.txt file")
+	saveCookies := flag.String("save-cookies", "", "Save cookies to a Netscape cookies.txt file on exit")
+
+	resign := flag.Bool("resign", false, "Fetch the master playlist again to obtain fresh URLs when requests are rejected with HTTP 401/403")
+	resignCommand := flag.String("resign-command", "", "Command that prints a fresh master playlist URL for -resign (original URL in $HLSDUMP_URL)")
+
+	propagateQuery := flag.String("propagate-query", "none", "Query parameters of the master playlist URL to add to all derived URLs (none, all or comma-separated names)")
+
+	flag.StringVar(&transport.TLS.CAFile, "cacert", "", "Trust CA certificates from PEM file instead of the system CAs")
+	flag.StringVar(&transport.TLS.CertFile, "cert", "", "Client certificate (PEM) for TLS")
+	flag.StringVar(&transport.TLS.KeyFile, "key", "", "Private key (PEM) for the client certificate (default: read from -cert)")
+	tlsMinVersion := flag.String("tls-min-version", "", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	var serverNames listFlag
+	flag.Var(&serverNames, "sni", "Override the TLS server name (SNI) used for a host (host=name)")
+	flag.BoolVar(&transport.TLS.InsecureSkipVerify, "insecure", false, "Do not verify TLS certificates (insecure!)")
+
+	var pins listFlag
+	flag.Var(&pins, "pin", "Require a certificate with the public key hash in the chain (sha256//<base64>)")
+
+	var resolve listFlag
+	flag.Var(&resolve, "resolve", "Connect to a specific address for host and port (host:port:addr)")
+	flag.StringVar(&transport.Interface, "interface", "", "Source IP address or network interface for all connections")
+	flag.IntVar(&transport.IPVersion, "ip-version", 0, "Prefer IPv4 (4) or IPv6 (6) addresses")
+
+	masterReload := flag.Duration("master-reload", 0, "Reload the master playlist at this interval to pick up added or removed variants (0 = disabled)")
+
+	metadata := flag.Bool("metadata", false, "Record all requests with the address of the server in <name>-metadata.jsonl")
+
+	httpLog := flag.String("http-log", "", "Record all HTTP exchanges with timings to a file (HAR if the name ends with .har, JSON lines otherwise)")
+	warc := flag.String("warc", "", "Write all requests and responses to a WARC/1.1 file (in addition to the usual output)")
+	warcOnly := flag.Bool("warc-only", false, "Only write the WARC file instead of the playlists, segments and keys")
+	snapshots := flag.Bool("snapshots", false, "Store the raw response of each media playlist reload in <name>-snapshots")
+
+	var redirect hls.RedirectPolicy
+	flag.IntVar(&redirect.MaxRedirects, "max-redirects", 0, "Maximum number of HTTP redirects per request (0 = 10, -1 = do not follow redirects)")
+	flag.BoolVar(&redirect.SameHost, "same-host-redirects", false, "Reject HTTP redirects to other hosts")
+	flag.BoolVar(&redirect.Reuse, "reuse-redirects", false, "Reload media playlists from the redirected URL")
+
+	conditionalReload := flag.Bool("conditional-reload", true, "Reload playlists with If-None-Match/If-Modified-Since")
+
+	stallTimeout := flag.Float64("stall-timeout", 0, "Number of target durations without progress after which a playlist is considered stalled (0 = disabled)")
+	stallActions := flag.String("stall-action", hls.StallWarn, "Actions for stalled playlists (comma-separated: warn, marker, hook, stop)")
+	stallCommand := flag.String("stall-command", "", "Command to run for stalled playlists with the hook action")
+
+	coalesceSpan := flag.Int64("coalesce-span", 0, "Maximum size in bytes of requests that fetch adjacent EXT-X-BYTERANGE segments of VOD playlists at once (0 = disabled)")
+
+	var retry hls.RetryPolicy
+	flag.IntVar(&retry.MaxAttempts, "retry-max", 0, "Maximum number of attempts per segment or playlist reload (0 = unlimited)")
+	flag.DurationVar(&retry.MaxElapsed, "retry-max-elapsed", 0, "Give up on segments that appeared in the playlist longer ago than this (0 = unlimited)")
+	flag.DurationVar(&retry.Backoff, "retry-backoff", 128*time.Millisecond, "Initial delay between retries (doubled for each attempt)")
+	flag.DurationVar(&retry.MaxBackoff, "retry-backoff-max", 1024*time.Millisecond, "Maximum delay between retries")
+	flag.Float64Var(&retry.Jitter, "retry-jitter", 0, "Randomize retry delays by up to this fraction")
+
+	var retryStatus listFlag
+	flag.Var(&retryStatus, "retry-status", "Number of retries for an HTTP status code before giving up on the stream (e.g. 404=3, -1 = unlimited)")
+
+	var retryErrors listFlag
+	flag.Var(&retryErrors, "retry-error", "Number of retries for an error kind (timeout, network, incomplete, status, other) before giving up on the stream")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -61,9 +171,83 @@ func parse() *hls.Dumper {
 	}
 
 	h, err := hls.ParseHeaders(headers)
-	if err != nil {
-		fmt.Fprintln(flag.CommandLine.Output(), err)
-		os.Exit(2)
+	checkUsage(err)
+
+	stall, err := hls.ParseStallActions(*stallActions)
+	checkUsage(err)
+
+	var rewriteRules []hls.RewriteRule
+	for _, value := range rewrites {
+		rule, err := hls.ParseRewriteRule(value)
+		checkUsage(err)
+		rewriteRules = append(rewriteRules, rule)
+	}
+
+	var rules []hls.HeaderRule
+	for _, value := range headerRules {
+		rule, err := hls.ParseHeaderRule(value)
+		checkUsage(err)
+		rules = append(rules, rule)
+	}
+
+	retry.Status, err = hls.ParseRetryStatus(retryStatus)
+	checkUsage(err)
+	retry.Errors, err = hls.ParseRetryOverrides(retryErrors)
+	checkUsage(err)
+
+	transport.DisableHTTP2 = !*http2
+	transport.DisableKeepAlives = !*keepAlive
+	if *proxy != "" {
+		transport.Proxy, err = hls.ParseProxy(*proxy)
+		checkUsage(err)
+	}
+	for _, hosts := range noProxy {
+		transport.NoProxy = append(transport.NoProxy, strings.Split(hosts, ",")...)
+	}
+	transport.HostProxies, err = hls.ParseHostProxies(hostProxies)
+	checkUsage(err)
+
+	if *tlsMinVersion != "" {
+		transport.TLS.MinVersion, err = hls.ParseTLSVersion(*tlsMinVersion)
+		checkUsage(err)
+	}
+	transport.TLS.Pins = pins
+	transport.TLS.ServerNames, err = hls.ParseServerNames(serverNames)
+	checkUsage(err)
+
+	transport.Resolve, err = hls.ParseResolve(resolve)
+	checkUsage(err)
+
+	var query []string
+	switch *propagateQuery {
+	case "none", "":
+	case "all":
+		query = []string{hls.QueryAll}
+	default:
+		query = strings.Split(*propagateQuery, ",")
+	}
+
+	if *outputDir != "" {
+		if *storage != "" {
+			checkUsage(errors.New("-output-dir cannot be combined with -storage"))
+		}
+		*storage = *outputDir
+	}
+	store, err := hls.ParseStorage(*storage, *s3Endpoint, *s3Region)
+	checkUsage(err)
+
+	if *warcOnly && *warc == "" {
+		checkUsage(errors.New("-warc-only requires -warc"))
+	}
+	if *mirror && *singleFile {
+		checkUsage(errors.New("-mirror cannot be combined with -single-file"))
+	}
+	checkUsage(hls.CheckTemplate(*playlistTemplate))
+	checkUsage(hls.CheckSegmentTemplate(*segmentTemplate, *singleFile))
+
+	jar := hls.NewCookieJar()
+	if *cookies != "" {
+		checkUsage(jar.Load(*cookies))
 	}
 
 	return &hls.Dumper{
@@ -75,13 +259,47 @@ func parse() *hls.Dumper {
 		Groups:     groups,
 		Titles:     titles,
 
+		Storage:          store,
+		PlaylistTemplate: *playlistTemplate,
+		SegmentTemplate:  *segmentTemplate,
+		Extension:        *extension,
+		Mirror:           *mirror,
+
+		HeaderRules: rules,
+		User:        *user,
+		BearerToken: *bearer,
+		AuthHosts:   authHosts,
+		UseNetrc:    *netrc || *netrcFile != "",
+		NetrcFile:   *netrcFile,
+		Rewrite:     rewriteRules,
+
 		PlaylistTimeout: *playlistTimeout,
 		SegmentTimeout:  *segmentTimeout,
+		Retry:           retry,
+		CoalesceSpan:    *coalesceSpan,
+		Transport:       transport,
+		Jar:             jar,
+		SaveCookies:     *saveCookies,
+		Resign:          *resign || *resignCommand != "",
+		ResignCommand:   *resignCommand,
+		PropagateQuery:  query,
+		MasterReload:    *masterReload,
+		Metadata:        *metadata,
+		Snapshots:       *snapshots,
+		HTTPLog:         *httpLog,
+		WARC:            *warc,
+		WARCOnly:        *warcOnly,
+		Redirect:        redirect,
+
+		DisableConditionalReload: !*conditionalReload,
+		StallTimeout:             *stallTimeout,
+		StallActions:             stall,
+		StallCommand:             *stallCommand,
 	}
 }
 
 func signalHandler(d *hls.Dumper) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	for sig := range c {
@@ -95,7 +313,9 @@ func main() {
 
 	go signalHandler(d)
 	err := d.Start()
-	if err != nil {
+	if err == hls.ErrStalled {
+		os.Exit(3)
+	} else if err != nil {
 		os.Exit(1)
 	}
 }